@@ -0,0 +1,231 @@
+package goQemu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	readyTimeout    = 120 * time.Second
+	shutdownTimeout = 180 * time.Second
+)
+
+func (q *Qemu) StartAll() error {
+	return q.StartAllContext(context.Background())
+}
+
+func (q *Qemu) StartAllContext(ctx context.Context) error {
+	configs, err := q.bootOrder()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, config := range configs {
+		if !config.OnBoot {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+
+		status, err := q.StatusContext(ctx, config.ID)
+		if err == nil && (status == StatusRunning || status == StatusPaused) {
+			continue
+		}
+
+		q.log().Info("autostart VM", "vmid", config.ID, "order", config.StartOrder, "delay", config.StartDelay)
+		if err := q.StartContext(ctx, config.ID); err != nil {
+			errs = append(errs, fmt.Errorf("VM %d: %w", config.ID, err))
+			continue
+		}
+
+		if config.StartDelay > 0 {
+			sleepContext(ctx, time.Duration(config.StartDelay)*time.Second)
+		} else if err := q.waitReady(ctx, config.ID, readyTimeout); err != nil {
+			q.warn(config.ID, "VM not ready, continue with next", err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// * reverse of StartAll, covers every running VM
+func (q *Qemu) StopAll() error {
+	return q.StopAllContext(context.Background())
+}
+
+func (q *Qemu) StopAllContext(ctx context.Context) error {
+	configs, err := q.bootOrder()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i := len(configs) - 1; i >= 0; i-- {
+		vmid := configs[i].ID
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+
+		status, err := q.StatusContext(ctx, vmid)
+		if err != nil || (status != StatusRunning && status != StatusPaused) {
+			continue
+		}
+
+		q.log().Info("autostop VM", "vmid", vmid)
+		if status == StatusPaused {
+			if err := q.ResumeContext(ctx, vmid); err != nil {
+				q.warn(vmid, "failed to resume before shutdown", err)
+			}
+		}
+
+		if err := q.ShutdownContext(ctx, vmid, shutdownTimeout); err != nil {
+			errs = append(errs, fmt.Errorf("VM %d: %w", vmid, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (q *Qemu) bootOrder() ([]*Config, error) {
+	ids, err := q.configIDs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configs: %w", err)
+	}
+
+	configs := make([]*Config, 0, len(ids))
+	for _, vmid := range ids {
+		config, err := q.readConfig(vmid)
+		if err != nil {
+			continue
+		}
+		configs = append(configs, config)
+	}
+
+	sort.SliceStable(configs, func(i, j int) bool {
+		a, b := configs[i], configs[j]
+		if a.StartOrder != b.StartOrder {
+			if a.StartOrder == 0 || b.StartOrder == 0 {
+				return b.StartOrder == 0
+			}
+			return a.StartOrder < b.StartOrder
+		}
+		return a.ID < b.ID
+	})
+
+	return configs, nil
+}
+
+// * ready once the guest agent answers
+func (q *Qemu) waitReady(ctx context.Context, vmid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, err := q.guestExecute(ctx, vmid, "guest-ping", nil, true); err == nil {
+			return nil
+		}
+		if err := sleepContext(ctx, 2*time.Second); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("guest agent did not respond within %s", timeout)
+}
+
+// * unit running command start-all/stop-all with the settings of this instance;
+// * .env files are referenced, not copied, so the default password stays out of the unit
+func (q *Qemu) SystemdUnit(command string) string {
+	var sb strings.Builder
+	sb.WriteString("[Unit]\n")
+	sb.WriteString("Description=go-qemu autostart\n")
+	sb.WriteString("After=network-online.target\n")
+	sb.WriteString("Wants=network-online.target\n")
+	sb.WriteString("\n[Service]\n")
+	sb.WriteString("Type=oneshot\n")
+	sb.WriteString("RemainAfterExit=yes\n")
+	if dir, err := os.Getwd(); err == nil {
+		// * relative paths resolve as they did for the command
+		sb.WriteString(fmt.Sprintf("WorkingDirectory=%s\n", systemdEscape(dir)))
+	}
+	for _, file := range q.envFiles {
+		sb.WriteString(fmt.Sprintf("EnvironmentFile=%s\n", systemdEscape(file)))
+	}
+	// * the environment wins over .env in WithEnv, the same holds for Environment= in systemd
+	for _, env := range q.unitEnv() {
+		sb.WriteString(fmt.Sprintf("Environment=%s\n", systemdQuote(env)))
+	}
+	sb.WriteString(fmt.Sprintf("ExecStart=%s start-all\n", systemdExec(command)))
+	sb.WriteString(fmt.Sprintf("ExecStop=%s stop-all\n", systemdExec(command)))
+	// * each VM falls back to SIGTERM, so StopAll is bounded
+	sb.WriteString("TimeoutStopSec=infinity\n")
+	sb.WriteString("\n[Install]\n")
+	sb.WriteString("WantedBy=multi-user.target\n")
+
+	return sb.String()
+}
+
+// * active GO_QEMU_* settings except the default password
+func (q *Qemu) unitEnv() []string {
+	path := q.path
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	env := []string{"GO_QEMU_PATH=" + path}
+
+	if q.storeName != "" {
+		env = append(env, "GO_QEMU_STORE="+q.storeName)
+	}
+	if q.seedURL != "" {
+		env = append(env, "GO_QEMU_SEED_URL="+q.seedURL)
+	}
+	if q.keySource != "" {
+		env = append(env, "GO_QEMU_KEY_SOURCE="+q.keySource)
+	}
+	if start, end := q.vmidRange(); start != defaultVMIDStart || end != defaultVMIDEnd {
+		env = append(env,
+			"GO_QEMU_VMID_START="+strconv.Itoa(start),
+			"GO_QEMU_VMID_END="+strconv.Itoa(end),
+		)
+	}
+
+	osNames := slices.Sorted(maps.Keys(defaultCatalog))
+	for _, osName := range osNames {
+		if versions := q.versions(osName); !slices.Equal(versions, defaultCatalog[osName]) {
+			env = append(env, "GO_QEMU_"+strings.ToUpper(osName)+"_VERSION="+strings.Join(versions, ","))
+		}
+	}
+
+	return env
+}
+
+// * specifiers start with %, everything else is taken as is
+func systemdEscape(value string) string {
+	return strings.ReplaceAll(value, "%", "%%")
+}
+
+// * one double-quoted word, C-style escapes are resolved by systemd
+func systemdQuote(value string) string {
+	value = strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+	).Replace(value)
+	return `"` + systemdEscape(value) + `"`
+}
+
+// * Exec lines also expand $VAR
+func systemdExec(value string) string {
+	return strings.ReplaceAll(systemdQuote(value), "$", "$$")
+}
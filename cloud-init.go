@@ -1,16 +1,75 @@
 package goQemu
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
-func (q *Qemu) generateCloudInit(config Config, cloudInit CloudInit) (string, error) {
+// * rebuild the ISO only when the rendered files differ from the hash saved with
+// * the config or the ISO is gone; true when config was changed and needs saving.
+// * With a seed URL the files are only rendered to validate, the seed serves them
+func (q *Qemu) ensureCloudInit(ctx context.Context, config *Config) (bool, error) {
+	files, err := q.renderCloudInit(*config)
+	if err != nil {
+		return false, err
+	}
+	if q.seedURL != "" {
+		return false, nil
+	}
+
+	hash := cloudInitHash(files)
+	ISOPath := q.cloudInitPath(config.ID)
+	if hash == config.CloudInitHash && config.CloudInitPath == ISOPath {
+		if _, err := os.Stat(ISOPath); err == nil {
+			return false, nil
+		}
+	}
+
+	if err := q.writeCloudInit(ctx, config.ID, files); err != nil {
+		return false, err
+	}
+
+	config.CloudInitPath = ISOPath
+	config.CloudInitHash = hash
+	return true, nil
+}
+
+func (q *Qemu) cloudInitPath(vmid int) string {
+	return filepath.Join(q.Folder.VM, fmt.Sprintf("%d-cloud-init.iso", vmid))
+}
+
+func cloudInitHash(files map[string]string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s\x00%d\x00%s", name, len(files[name]), files[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// * meta-data, user-data and network-config by file name, a function of the config
+// * only: nothing is read from the host or written, keys are resolved by Create/Update
+func (q *Qemu) renderCloudInit(config Config) (map[string]string, error) {
+	cloudInit := config.CloudInit
 	if config.Options.UUID == "" {
-		return "", fmt.Errorf("UUID is required for cloud-init")
+		return nil, configError("options.uuid", "UUID is required for cloud-init")
 	}
 
 	if !map[string]bool{
@@ -20,7 +79,7 @@ func (q *Qemu) generateCloudInit(config Config, cloudInit CloudInit) (string, er
 		"rockylinux": true,
 		"almalinux":  true,
 	}[strings.ToLower(config.OS)] {
-		return "", fmt.Errorf("unsupported OS: %s", config.OS)
+		return nil, configError("os", "unsupported OS: %s", config.OS)
 	}
 
 	if cloudInit.Hostname == "" {
@@ -31,188 +90,245 @@ func (q *Qemu) generateCloudInit(config Config, cloudInit CloudInit) (string, er
 		cloudInit.Username = config.OS
 	}
 
-	if cloudInit.Password == "" {
-		cloudInit.Password = "passwd"
+	if !validUsername.MatchString(cloudInit.Username) {
+		return nil, configError("cloud_init.username", "invalid username: %q", cloudInit.Username)
 	}
-
-	tmpFolder := fmt.Sprintf(".cloudinit-%d", config.ID)
-	tmpFolderPath := filepath.Join(q.Folder.VM, tmpFolder)
-	if err := os.MkdirAll(tmpFolderPath, 0755); err != nil {
-		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	if strings.ContainsAny(cloudInit.Password, "\r\n") {
+		return nil, configError("cloud_init.passwd", "password must not contain line breaks")
 	}
-	if os.Getenv("TEST_MODE") != "true" {
-		defer os.RemoveAll(tmpFolderPath)
+	if cloudInit.PasswordHash != "" && !validHashedPasswd.MatchString(cloudInit.PasswordHash) {
+		return nil, configError("cloud_init.passwd_hash", "expected a crypt(3) hash such as $6$salt$hash")
 	}
+	if err := checkCloudInitExtras(cloudInit); err != nil {
+		return nil, err
+	}
+	if err := checkUsers(cloudInit.Users); err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]string)
 
-	// * generate meta-data
-	metaData := fmt.Sprintf(`
-instance-id: %s
-local-hostname: %s
-`, config.Options.UUID, cloudInit.Hostname)
-	metaDataPath := filepath.Join(tmpFolderPath, "meta-data")
-	if err := os.WriteFile(metaDataPath, []byte(metaData), 0644); err != nil {
-		return "", fmt.Errorf("failed to write meta-data: %w", err)
+	metaData, err := marshalYAML("", cloudMetaData{
+		InstanceID:    config.Options.UUID,
+		LocalHostname: cloudInit.Hostname,
+	})
+	if err != nil {
+		return nil, err
 	}
+	files["meta-data"] = metaData
 
 	// * generate user-data
-	sshKey := cloudInit.AuthorizedKey
-	if sshKey == "" {
-		homeDir, _ := os.UserHomeDir()
-		keyPaths := []string{
-			filepath.Join(homeDir, ".ssh", "id_ed25519.pub"),
-			filepath.Join(homeDir, ".ssh", "id_rsa.pub"),
-			filepath.Join(homeDir, ".ssh", "id_ecdsa.pub"),
-		}
+	userData := cloudConfig{
+		SSHPwauth:      cloudInit.SSHPasswordAuth == nil || *cloudInit.SSHPasswordAuth,
+		PackageUpgrade: cloudInit.UpgradePackages,
+		Packages:       uniqueStrings([]string{"qemu-guest-agent"}, cloudInit.Packages),
+		WriteFiles:     cloudWriteFiles(cloudInit.WriteFiles),
+		ResolvConf:     q.generateDNSConfig(&cloudInit),
+		Runcmd: []any{
+			[]string{"sh", "-c", `ping -c 3 $(ip route | grep default | awk "{print \$3}") >/dev/null 2>&1 &`},
+			[]string{"sh", "-c", "(sleep 3 && rm -rf /var/lib/cloud/instance /var/lib/cloud/instances/*) &"},
+			[]string{"systemctl", "enable", "qemu-guest-agent"},
+			[]string{"systemctl", "start", "qemu-guest-agent"},
+		},
+	}
+	userData.ManageResolvConf = userData.ResolvConf != nil
 
-		for _, keyPath := range keyPaths {
-			if data, err := os.ReadFile(keyPath); err == nil {
-				sshKey = strings.TrimSpace(string(data))
-				break
-			}
+	if len(cloudInit.Users) > 0 {
+		userData.Users = cloudUsers(cloudInit.Users, config.Options.UUID)
+	} else {
+		user := cloudUser{
+			Name:              cloudInit.Username,
+			Sudo:              "ALL=(ALL) NOPASSWD:ALL",
+			SSHAuthorizedKeys: splitKeys(cloudInit.AuthorizedKey),
+			Shell:             "/bin/bash",
+			Passwd:            cloudInit.PasswordHash,
+		}
+		if cloudInit.Password != "" {
+			user.Passwd = sha512Crypt(cloudInit.Password, stableSalt(config.Options.UUID+"\x00"+cloudInit.Username), 0)
 		}
+		// * cloud-init locks the password unless told otherwise
+		if user.Passwd != "" {
+			unlocked := false
+			user.LockPasswd = &unlocked
+		}
+		userData.Users = []cloudUser{user}
+	}
+	for _, command := range cloudInit.Bootcmd {
+		userData.Bootcmd = append(userData.Bootcmd, command)
+	}
+	for _, command := range cloudInit.Runcmd {
+		userData.Runcmd = append(userData.Runcmd, command)
+	}
+
+	if files["user-data"], err = renderUserData(userData, cloudInit.UserData); err != nil {
+		return nil, err
+	}
 
-		// * pubkey not exist, then generate
-		if sshKey == "" {
-			privateKeyPath := filepath.Join(homeDir, ".ssh", "id_ed25519")
-			publicKeyPath := privateKeyPath + ".pub"
-
-			cmd := exec.Command("ssh-keygen",
-				"-t", "ed25519",
-				"-f", privateKeyPath,
-				"-N", "",
-			)
-			if err := cmd.Run(); err != nil {
-				return "", fmt.Errorf("failed to generate SSH key: %w", err)
-			}
-			if data, err := os.ReadFile(publicKeyPath); err == nil {
-				sshKey = strings.TrimSpace(string(data))
-			}
+	if networkConfig := q.generateNetworkConfigFile(&cloudInit); networkConfig != nil {
+		if files["network-config"], err = marshalYAML("", networkConfig); err != nil {
+			return nil, err
 		}
 	}
 
-	upgradePackages := "false"
-	if cloudInit.UpgradePackages {
-		upgradePackages = "true"
+	return files, nil
+}
+
+// * public key of the host user, generated if missing
+func hostSSHKey(ctx context.Context) (string, error) {
+	homeDir, _ := os.UserHomeDir()
+	keyPaths := []string{
+		filepath.Join(homeDir, ".ssh", "id_ed25519.pub"),
+		filepath.Join(homeDir, ".ssh", "id_rsa.pub"),
+		filepath.Join(homeDir, ".ssh", "id_ecdsa.pub"),
 	}
 
-	userData := fmt.Sprintf(`#cloud-config
-users:
-  - name: %s
-    sudo: ALL=(ALL) NOPASSWD:ALL
-    ssh_authorized_keys:
-      - %s
-    shell: /bin/bash
+	for _, keyPath := range keyPaths {
+		if data, err := os.ReadFile(keyPath); err == nil {
+			return strings.TrimSpace(string(data)), nil
+		}
+	}
 
-ssh_pwauth: true
+	// * pubkey not exist, then generate
+	privateKeyPath := filepath.Join(homeDir, ".ssh", "id_ed25519")
+	publicKeyPath := privateKeyPath + ".pub"
 
-chpasswd:
-  list: |
-    %s:%s
-  expire: false
+	cmd := exec.CommandContext(ctx, "ssh-keygen",
+		"-t", "ed25519",
+		"-f", privateKeyPath,
+		"-N", "",
+	)
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to generate SSH key: %w", err)
+	}
+	data, err := os.ReadFile(publicKeyPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read SSH key: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
 
-package_upgrade: %s
+// * the ISO is built next to the old one and renamed over it, a failure keeps the old ISO
+func (q *Qemu) writeCloudInit(ctx context.Context, vmid int, files map[string]string) error {
+	ISOPath := q.cloudInitPath(vmid)
+	tmpISOPath := filepath.Join(q.Folder.VM, fmt.Sprintf(".%d-cloud-init.iso.tmp", vmid))
 
-packages:
-  - qemu-guest-agent
-`, cloudInit.Username, sshKey, cloudInit.Username, cloudInit.Password, upgradePackages)
+	err := writeISOFile(tmpISOPath, files)
+	if err != nil {
+		q.warn(vmid, "built-in ISO writer failed, fallback to genisoimage", err)
+		err = q.writeISOExternal(ctx, vmid, tmpISOPath, files)
+	}
+	if err != nil {
+		os.Remove(tmpISOPath)
+		return err
+	}
 
-	// if cloudInit.NetworkConfig != nil {
-	dnsConfig := q.generateDNSConfig(&cloudInit)
-	if dnsConfig != "" {
-		userData += "\n" + dnsConfig
+	if err := os.Rename(tmpISOPath, ISOPath); err != nil {
+		os.Remove(tmpISOPath)
+		return fmt.Errorf("failed to save cloud-init ISO: %w", err)
 	}
-	// }
 
-	userData += `
-runcmd:
-  - [ sh, -c, 'ping -c 3 $(ip route | grep default | awk "{print \$3}") >/dev/null 2>&1 &' ]
-  - [ sh, -c, '(sleep 3 && rm -rf /var/lib/cloud/instance /var/lib/cloud/instances/*) &' ]
-  - [ systemctl, enable, qemu-guest-agent ]
-  - [ systemctl, start, qemu-guest-agent ]
-`
+	q.infof(vmid, "created cloud-init ISO: %s", ISOPath)
+	return nil
+}
 
-	userDataPath := filepath.Join(tmpFolderPath, "user-data")
-	if err := os.WriteFile(userDataPath, []byte(userData), 0644); err != nil {
-		return "", fmt.Errorf("failed to write user-data: %w", err)
+func writeISOFile(path string, files map[string]string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
 	}
 
-	isoFiles := []string{metaDataPath, userDataPath}
+	if err := writeISO(file, "cidata", files, time.Now()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
 
-	// if cloudInit.NetworkConfig != nil {
-	networkConfigData := q.generateNetworkConfigFile(&cloudInit)
-	if networkConfigData != "" {
-		networkConfigPath := filepath.Join(tmpFolderPath, "network-config")
-		if err := os.WriteFile(networkConfigPath, []byte(networkConfigData), 0644); err != nil {
-			return "", fmt.Errorf("failed to write network-config: %w", err)
-		}
-		isoFiles = append(isoFiles, networkConfigPath)
+// * genisoimage or mkisofs from PATH
+func (q *Qemu) writeISOExternal(ctx context.Context, vmid int, tmpISOPath string, files map[string]string) error {
+	tmpFolder := fmt.Sprintf(".cloudinit-%d", vmid)
+	tmpFolderPath := filepath.Join(q.Folder.VM, tmpFolder)
+	if err := os.MkdirAll(tmpFolderPath, 0755); err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	if os.Getenv("TEST_MODE") != "true" {
+		defer os.RemoveAll(tmpFolderPath)
 	}
-	// }
 
-	ISO := fmt.Sprintf("%d-cloud-init.iso", config.ID)
-	ISOPath := filepath.Join(q.Folder.VM, ISO)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	isoFiles := make([]string, 0, len(names))
+	for _, name := range names {
+		path := filepath.Join(tmpFolderPath, name)
+		if err := os.WriteFile(path, []byte(files[name]), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		isoFiles = append(isoFiles, path)
+	}
 
 	var cmd *exec.Cmd
 	if _, err := exec.LookPath("genisoimage"); err == nil {
 		args := []string{
-			"-output", ISOPath,
+			"-output", tmpISOPath,
 			"-volid", "cidata",
 			"-joliet",
 			"-rock",
 		}
 		args = append(args, isoFiles...)
-		cmd = exec.Command("genisoimage", args...)
+		cmd = exec.CommandContext(ctx, "genisoimage", args...)
 	} else if _, err := exec.LookPath("mkisofs"); err == nil {
 		args := []string{
-			"-output", ISOPath,
+			"-output", tmpISOPath,
 			"-volid", "cidata",
 			"-joliet",
 			"-rock",
 		}
 		args = append(args, isoFiles...)
-		cmd = exec.Command("mkisofs", args...)
+		cmd = exec.CommandContext(ctx, "mkisofs", args...)
 	} else {
-		return "", fmt.Errorf("failed to create cloud-init ISO: neither genisoimage nor mkisofs found in system")
+		return fmt.Errorf("failed to create cloud-init ISO: neither genisoimage nor mkisofs found in system")
 	}
 
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to create cloud-init ISO: %w", err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("failed to create cloud-init ISO: %w", err)
 	}
 
-	fmt.Printf("[*] created cloud-init ISO: %s\n", ISOPath)
-	return ISOPath, nil
+	return nil
+
 }
 
-func (q *Qemu) generateDNSConfig(netConfig *CloudInit) string {
+func (q *Qemu) generateDNSConfig(netConfig *CloudInit) *cloudResolvConf {
 	if netConfig == nil {
-		return ""
+		return nil
 	}
 
 	if len(netConfig.DNSServers) == 0 && netConfig.DNSDomain == "" {
-		return ""
-	}
-
-	config := "manage_resolv_conf: true\n"
-	config += "resolv_conf:\n"
-
-	if len(netConfig.DNSServers) > 0 {
-		config += "  nameservers:\n"
-		for _, dns := range netConfig.DNSServers {
-			config += fmt.Sprintf("    - %s\n", dns)
-		}
+		return nil
 	}
 
+	config := &cloudResolvConf{Nameservers: netConfig.DNSServers}
 	if netConfig.DNSDomain != "" {
-		config += "  searchdomains:\n"
-		config += fmt.Sprintf("    - %s\n", netConfig.DNSDomain)
+		config.SearchDomains = []string{netConfig.DNSDomain}
 	}
 
 	return config
 }
 
-func (q *Qemu) generateNetworkConfigFile(netConfig *CloudInit) string {
+// * netplan v2, nil keeps the image default of DHCP
+func (q *Qemu) generateNetworkConfigFile(netConfig *CloudInit) *cloudNetworkConfig {
 	if netConfig == nil {
-		return ""
+		return nil
 	}
 
 	ipv4 := getIPConfig(netConfig.IPv4)
@@ -222,74 +338,64 @@ func (q *Qemu) generateNetworkConfigFile(netConfig *CloudInit) string {
 	hasIPv6 := ipv6.Mode == "static" && ipv6.Address != ""
 
 	if !hasIPv4 && !hasIPv6 {
-		return ""
+		return nil
 	}
 
-	config := "version: 2\nethernets:\n  eth0:\n"
-	addresses := []string{}
+	eth := cloudEthernet{}
 
-	if hasIPv4 && ipv4.Address != "" {
-		addresses = append(addresses, ipv4.Address)
+	if hasIPv4 {
+		eth.Addresses = append(eth.Addresses, ipv4.Address)
+		eth.Gateway4 = ipv4.Gateway
 	}
 
-	if hasIPv6 && ipv6.Address != "" {
-		addresses = append(addresses, ipv6.Address)
+	if hasIPv6 {
+		eth.Addresses = append(eth.Addresses, ipv6.Address)
+		eth.Gateway6 = ipv6.Gateway
 	}
 
-	if len(addresses) > 0 {
-		config += "    addresses:\n"
-		for _, addr := range addresses {
-			config += fmt.Sprintf("      - %s\n", addr)
-		}
+	if ipv4.Mode == "dhcp" && !hasIPv4 {
+		eth.DHCP4 = true
 	}
 
-	if hasIPv4 && ipv4.Gateway != "" {
-		config += fmt.Sprintf("    gateway4: %s\n", ipv4.Gateway)
-	}
-
-	if hasIPv6 && ipv6.Gateway != "" {
-		config += fmt.Sprintf("    gateway6: %s\n", ipv6.Gateway)
+	if ipv6.Mode == "dhcp" {
+		eth.DHCP6 = true
+	} else if ipv6.Mode == "slaac" {
+		acceptRA := true
+		eth.AcceptRA = &acceptRA
 	}
 
-	dhcp4 := "no"
-	dhcp6 := "no"
-
-	if ipv4.Mode == "dhcp" {
-		if !hasIPv4 {
-			dhcp4 = "yes"
+	if len(netConfig.DNSServers) > 0 {
+		eth.Nameservers = &cloudNameservers{Addresses: netConfig.DNSServers}
+		if netConfig.DNSDomain != "" {
+			eth.Nameservers.Search = []string{netConfig.DNSDomain}
 		}
 	}
 
-	if ipv6.Mode == "dhcp" {
-		dhcp6 = "yes"
-	} else if ipv6.Mode == "slaac" {
-		dhcp6 = "no"
-		config += "    accept-ra: yes\n"
+	return &cloudNetworkConfig{
+		Version:   2,
+		Ethernets: map[string]cloudEthernet{"eth0": eth},
 	}
+}
 
-	config += fmt.Sprintf("    dhcp4: %s\n", dhcp4)
-	config += fmt.Sprintf("    dhcp6: %s\n", dhcp6)
-
-	if len(netConfig.DNSServers) > 0 {
-		config += "    nameservers:\n"
-		config += "      addresses:\n"
-		for _, dns := range netConfig.DNSServers {
-			config += fmt.Sprintf("        - %s\n", dns)
-		}
+// * the encoder quotes and escapes every value, so no input can add keys
+func marshalYAML(header string, value any) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString(header)
 
-		if netConfig.DNSDomain != "" {
-			config += "      search:\n"
-			config += fmt.Sprintf("        - %s\n", netConfig.DNSDomain)
-		}
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(value); err != nil {
+		return "", fmt.Errorf("failed to encode cloud-init: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return "", fmt.Errorf("failed to encode cloud-init: %w", err)
 	}
 
-	return config
+	return buf.String(), nil
 }
 
 func (q *Qemu) removeCloudInit(vmid int) {
-	ISO := fmt.Sprintf("%d-cloud-init.iso", vmid)
-	ISOPath := filepath.Join(q.Folder.VM, ISO)
-	os.Remove(ISOPath)
+	os.Remove(q.cloudInitPath(vmid))
 }
 
 func getIPConfig(value string) IPConfig {
@@ -315,3 +421,67 @@ func getIPConfig(value string) IPConfig {
 
 	return config
 }
+
+var validUsername = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+type cloudMetaData struct {
+	InstanceID    string `yaml:"instance-id"`
+	LocalHostname string `yaml:"local-hostname"`
+}
+
+// * #cloud-config user-data, field order is the output order
+type cloudConfig struct {
+	Users            []cloudUser      `yaml:"users"`
+	SSHPwauth        bool             `yaml:"ssh_pwauth"`
+	PackageUpgrade   bool             `yaml:"package_upgrade"`
+	Packages         []string         `yaml:"packages,omitempty"`
+	WriteFiles       []cloudWriteFile `yaml:"write_files,omitempty"`
+	ManageResolvConf bool             `yaml:"manage_resolv_conf,omitempty"`
+	ResolvConf       *cloudResolvConf `yaml:"resolv_conf,omitempty"`
+	Bootcmd          []any            `yaml:"bootcmd,omitempty"`
+	Runcmd           []any            `yaml:"runcmd,omitempty"` // * argv lists or shell strings
+}
+
+type cloudUser struct {
+	Name              string   `yaml:"name"`
+	Groups            string   `yaml:"groups,omitempty"` // * comma separated, read by every cloud-init version
+	Sudo              string   `yaml:"sudo,omitempty"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+	Shell             string   `yaml:"shell,omitempty"`
+	LockPasswd        *bool    `yaml:"lock_passwd,omitempty"`
+	Passwd            string   `yaml:"passwd,omitempty"`
+}
+
+type cloudWriteFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Encoding    string `yaml:"encoding,omitempty"`
+	Owner       string `yaml:"owner,omitempty"`
+	Permissions string `yaml:"permissions,omitempty"`
+	Append      bool   `yaml:"append,omitempty"`
+}
+
+type cloudResolvConf struct {
+	Nameservers   []string `yaml:"nameservers,omitempty"`
+	SearchDomains []string `yaml:"searchdomains,omitempty"`
+}
+
+type cloudNetworkConfig struct {
+	Version   int                      `yaml:"version"`
+	Ethernets map[string]cloudEthernet `yaml:"ethernets"`
+}
+
+type cloudEthernet struct {
+	Addresses   []string          `yaml:"addresses,omitempty"`
+	Gateway4    string            `yaml:"gateway4,omitempty"`
+	Gateway6    string            `yaml:"gateway6,omitempty"`
+	AcceptRA    *bool             `yaml:"accept-ra,omitempty"`
+	DHCP4       bool              `yaml:"dhcp4"`
+	DHCP6       bool              `yaml:"dhcp6"`
+	Nameservers *cloudNameservers `yaml:"nameservers,omitempty"`
+}
+
+type cloudNameservers struct {
+	Addresses []string `yaml:"addresses,omitempty"`
+	Search    []string `yaml:"search,omitempty"`
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	goQemu "github.com/pardnchiu/go-qemu"
+)
+
+type api struct {
+	qemu *goQemu.Qemu
+}
+
+type createRequest struct {
+	Config goQemu.Config `json:"config"`
+	SSH    string        `json:"ssh"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Field string `json:"field,omitempty"`
+}
+
+func newAPI(qemu *goQemu.Qemu) *api {
+	return &api{qemu: qemu}
+}
+
+func (a *api) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /v1/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	mux.HandleFunc("GET /v1/vms", a.list)
+	mux.HandleFunc("POST /v1/vms", a.create)
+	mux.HandleFunc("GET /v1/vms/{id}", a.get)
+	mux.HandleFunc("PATCH /v1/vms/{id}", a.update)
+	mux.HandleFunc("DELETE /v1/vms/{id}", a.action(a.qemu.DeleteContext))
+	mux.HandleFunc("POST /v1/vms/{id}/revert", a.revert)
+	mux.HandleFunc("GET /v1/vms/{id}/vnc", a.vnc)
+
+	mux.HandleFunc("POST /v1/vms/{id}/start", a.action(a.qemu.StartContext))
+	mux.HandleFunc("POST /v1/vms/{id}/stop", a.action(a.qemu.StopContext))
+	mux.HandleFunc("POST /v1/vms/{id}/shutdown", a.shutdown)
+	mux.HandleFunc("POST /v1/vms/{id}/pause", a.action(a.qemu.PauseContext))
+	mux.HandleFunc("POST /v1/vms/{id}/resume", a.action(a.qemu.ResumeContext))
+	mux.HandleFunc("POST /v1/vms/{id}/reset", a.action(a.qemu.ResetContext))
+	mux.HandleFunc("POST /v1/vms/{id}/reboot", a.action(a.qemu.RebootContext))
+
+	mux.HandleFunc("POST /v1/reconcile", a.reconcile)
+
+	mux.HandleFunc("GET /v1/tasks", a.tasks)
+	mux.HandleFunc("GET /v1/tasks/{id}", a.task)
+	mux.HandleFunc("DELETE /v1/tasks/{id}", a.cancelTask)
+
+	return logRequests(mux)
+}
+
+func (a *api) list(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.qemu.ListContext(r.Context()))
+}
+
+func (a *api) get(w http.ResponseWriter, r *http.Request) {
+	vmid, ok := pathVMID(w, r)
+	if !ok {
+		return
+	}
+
+	instance, err := a.qemu.GetContext(r.Context(), vmid)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, instance)
+}
+
+func (a *api) create(w http.ResponseWriter, r *http.Request) {
+	var req createRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid request body: " + err.Error()})
+		return
+	}
+
+	// * image download can take minutes, poll /v1/tasks/{id}
+	task, err := a.qemu.CreateAsync(req.Config, req.SSH)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/tasks/"+task.ID)
+	writeJSON(w, http.StatusAccepted, task)
+}
+
+func (a *api) update(w http.ResponseWriter, r *http.Request) {
+	vmid, ok := pathVMID(w, r)
+	if !ok {
+		return
+	}
+
+	var patch goQemu.ConfigPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid request body: " + err.Error()})
+		return
+	}
+
+	instance, err := a.qemu.UpdateContext(r.Context(), vmid, patch)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, instance)
+}
+
+func (a *api) revert(w http.ResponseWriter, r *http.Request) {
+	vmid, ok := pathVMID(w, r)
+	if !ok {
+		return
+	}
+
+	instance, err := a.qemu.RevertContext(r.Context(), vmid)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, instance)
+}
+
+func (a *api) tasks(w http.ResponseWriter, r *http.Request) {
+	tasks, err := a.qemu.Tasks()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+func (a *api) task(w http.ResponseWriter, r *http.Request) {
+	task, err := a.qemu.Task(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, task)
+}
+
+func (a *api) cancelTask(w http.ResponseWriter, r *http.Request) {
+	if err := a.qemu.CancelTask(r.PathValue("id")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *api) shutdown(w http.ResponseWriter, r *http.Request) {
+	vmid, ok := pathVMID(w, r)
+	if !ok {
+		return
+	}
+
+	timeout := 180 * time.Second
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "timeout must be a positive number of seconds"})
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	if err := a.qemu.ShutdownContext(r.Context(), vmid, timeout); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) vnc(w http.ResponseWriter, r *http.Request) {
+	vmid, ok := pathVMID(w, r)
+	if !ok {
+		return
+	}
+
+	url, err := a.qemu.VNCAddressContext(r.Context(), vmid)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"url": url})
+}
+
+func (a *api) reconcile(w http.ResponseWriter, r *http.Request) {
+	report, err := a.qemu.ReconcileContext(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (a *api) action(fn func(context.Context, int) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vmid, ok := pathVMID(w, r)
+		if !ok {
+			return
+		}
+
+		if err := fn(r.Context(), vmid); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func pathVMID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	vmid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || vmid <= 0 {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid VMID: " + r.PathValue("id")})
+		return 0, false
+	}
+	return vmid, true
+}
+
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Warn("failed to write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	resp := errorResponse{Error: err.Error()}
+	var configErr *goQemu.ConfigError
+	if errors.As(err, &configErr) {
+		resp.Field = configErr.Field
+	}
+	writeJSON(w, statusCode(err), resp)
+}
+
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, goQemu.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, goQemu.ErrAlreadyRunning), errors.Is(err, goQemu.ErrNotRunning),
+		errors.Is(err, goQemu.ErrInvalidState), errors.Is(err, goQemu.ErrVMIDInUse),
+		errors.Is(err, goQemu.ErrNoVMIDAvailable), errors.Is(err, goQemu.ErrLocked):
+		return http.StatusConflict
+	case errors.Is(err, goQemu.ErrInvalidConfig):
+		return http.StatusBadRequest
+	case errors.Is(err, goQemu.ErrImageUnavailable):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		slog.Info("request", "method", r.Method, "path", r.URL.Path, "status", rec.code, "duration", time.Since(start))
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	goQemu "github.com/pardnchiu/go-qemu"
+)
+
+// * every image request fails, create tasks end without touching the network
+type unavailableTransport struct{}
+
+func (unavailableTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusNotFound,
+		Status:     "404 Not Found",
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    r,
+	}, nil
+}
+
+func newTestServer(t *testing.T) (*goQemu.Qemu, *httptest.Server) {
+	t.Helper()
+	qemu, err := goQemu.NewQemu(
+		goQemu.WithPath(t.TempDir()),
+		goQemu.WithBinary("/bin/true"),
+		goQemu.WithHTTPClient(&http.Client{Transport: unavailableTransport{}}),
+	)
+	if err != nil {
+		t.Fatalf("NewQemu failed: %v", err)
+	}
+	t.Cleanup(func() { qemu.Close() })
+
+	server := httptest.NewServer(newAPI(qemu).routes())
+	t.Cleanup(server.Close)
+	return qemu, server
+}
+
+func saveTestConfig(t *testing.T, qemu *goQemu.Qemu, config goQemu.Config) {
+	t.Helper()
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := goQemu.NewDirStore(qemu.Folder).Put(goQemu.KindConfig, "101", data); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+}
+
+func doRequest(t *testing.T, method, url, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("Decode %s %s failed: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAPI(t *testing.T) {
+	qemu, server := newTestServer(t)
+	saveTestConfig(t, qemu, goQemu.Config{
+		ID:       101,
+		Hostname: "debian-101.vm",
+		OS:       "debian",
+		Version:  "12",
+		Memory:   2048,
+		CPUs:     2,
+		Disks:    []goQemu.Disk{{Path: "/tmp/101-0.qcow2", Format: "qcow2"}},
+		Options:  goQemu.Options{UUID: "123e4567-e89b-12d3-a456-426614174000"},
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		expect int
+		field  string
+	}{
+		{"health", "GET", "/v1/health", "", http.StatusOK, ""},
+		{"list", "GET", "/v1/vms", "", http.StatusOK, ""},
+		{"get", "GET", "/v1/vms/101", "", http.StatusOK, ""},
+		{"get not found", "GET", "/v1/vms/199", "", http.StatusNotFound, ""},
+		{"invalid VMID", "GET", "/v1/vms/abc", "", http.StatusBadRequest, ""},
+		{"stop not running", "POST", "/v1/vms/101/stop", "", http.StatusConflict, ""},
+		{"create invalid body", "POST", "/v1/vms", "{", http.StatusBadRequest, ""},
+		{"create without OS", "POST", "/v1/vms", `{"config":{"memory":1024}}`, http.StatusBadRequest, "os"},
+		{"create unknown version", "POST", "/v1/vms", `{"config":{"os":"debian","version":"1"}}`, http.StatusUnprocessableEntity, ""},
+		{"update invalid memory", "PATCH", "/v1/vms/101", `{"memory":-1}`, http.StatusBadRequest, "memory"},
+		{"task not found", "GET", "/v1/tasks/00000000-0000-0000-0000-000000000000", "", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body any
+			code := doRequest(t, tt.method, server.URL+tt.path, tt.body, &body)
+			if code != tt.expect {
+				t.Errorf("Expected %d, got %d: %v", tt.expect, code, body)
+			}
+			if resp, _ := body.(map[string]any); tt.field != "" && resp["field"] != tt.field {
+				t.Errorf("Expected field %q, got %v", tt.field, body)
+			}
+		})
+	}
+}
+
+func TestAPI_Get(t *testing.T) {
+	qemu, server := newTestServer(t)
+	saveTestConfig(t, qemu, goQemu.Config{
+		ID:       101,
+		Hostname: "debian-101.vm",
+		OS:       "debian",
+		Version:  "12",
+		Options:  goQemu.Options{UUID: "123e4567-e89b-12d3-a456-426614174000"},
+	})
+
+	var instance goQemu.Instance
+	if code := doRequest(t, "GET", server.URL+"/v1/vms/101", "", &instance); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if instance.Config.ID != 101 || instance.Config.Hostname != "debian-101.vm" {
+		t.Errorf("Unexpected instance: %+v", instance.Config)
+	}
+	if instance.Status != goQemu.StatusStopped {
+		t.Errorf("Expected status %s, got %s", goQemu.StatusStopped, instance.Status)
+	}
+}
+
+func TestAPI_Locked(t *testing.T) {
+	qemu, server := newTestServer(t)
+	saveTestConfig(t, qemu, goQemu.Config{ID: 101, Hostname: "debian-101.vm"})
+
+	release, err := qemu.Lock(101, "update")
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	defer release()
+
+	var body map[string]any
+	if code := doRequest(t, "POST", server.URL+"/v1/vms/101/start", "", &body); code != http.StatusConflict {
+		t.Errorf("Expected 409 while locked, got %d: %v", code, body)
+	}
+	if code := doRequest(t, "DELETE", server.URL+"/v1/vms/101", "", &body); code != http.StatusConflict {
+		t.Errorf("Expected 409 while locked, got %d: %v", code, body)
+	}
+}
+
+func TestAPI_CreateTask(t *testing.T) {
+	_, server := newTestServer(t)
+
+	req, _ := http.NewRequest("POST", server.URL+"/v1/vms", strings.NewReader(`{"config":{"os":"debian","version":"12"}}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /v1/vms failed: %v", err)
+	}
+	var task goQemu.Task
+	json.NewDecoder(resp.Body).Decode(&task)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", resp.StatusCode)
+	}
+	if location := resp.Header.Get("Location"); location != "/v1/tasks/"+task.ID {
+		t.Errorf("Expected Location of the task, got %q", location)
+	}
+
+	// * the image download fails, the task ends as failed
+	deadline := time.Now().Add(10 * time.Second)
+	for task.Status == goQemu.TaskPending || task.Status == goQemu.TaskRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("Task did not finish: %s %s", task.Status, task.Phase)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if code := doRequest(t, "GET", server.URL+"/v1/tasks/"+task.ID, "", &task); code != http.StatusOK {
+			t.Fatalf("Expected 200 polling the task, got %d", code)
+		}
+	}
+	if task.Status != goQemu.TaskFailed || task.Error == "" {
+		t.Errorf("Expected failed task with error, got %s %q", task.Status, task.Error)
+	}
+	if task.Result != nil {
+		t.Errorf("Expected no result for a failed create, got %+v", task.Result)
+	}
+
+	var tasks []*goQemu.Task
+	if code := doRequest(t, "GET", server.URL+"/v1/tasks", "", &tasks); code != http.StatusOK || len(tasks) != 1 {
+		t.Errorf("Expected the task in the list, got %d: %+v", code, tasks)
+	}
+}
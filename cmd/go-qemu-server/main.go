@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	goQemu "github.com/pardnchiu/go-qemu"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8080", "TCP address or unix:/path/to.sock")
+	supervise := flag.Bool("supervise", true, "run the restart supervisor")
+	seedListen := flag.String("seed-listen", "", "address of the cloud-init seed server, defaults to the host of GO_QEMU_SEED_URL")
+	flag.Parse()
+
+	if err := run(*listen, *supervise, *seedListen); err != nil {
+		slog.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(listen string, supervise bool, seedListen string) error {
+	// * stdout is not ours, progress is exposed through /v1/tasks
+	qemu, err := goQemu.NewQemu(
+		goQemu.WithEnv(),
+		goQemu.WithObserver(goQemu.ObserverFunc(logEvent)),
+	)
+	if err != nil {
+		return err
+	}
+	defer qemu.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if supervise {
+		go qemu.NewSupervisor(0).Run(ctx)
+	}
+
+	// * guests booted without the ISO fetch their cloud-init from here
+	if seedURL := qemu.SeedURL(); seedURL != "" {
+		go func() {
+			if err := qemu.ServeSeed(ctx, seedListen); err != nil {
+				slog.Error("seed server stopped", "error", err)
+				stop()
+			}
+		}()
+		slog.Info("cloud-init seed server started", "url", seedURL)
+	}
+
+	listener, err := listenOn(listen)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           newAPI(qemu).routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("go-qemu server listening", "address", listen)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func listenOn(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		// * remove socket left by a previous run
+		os.Remove(path)
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0660); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	return net.Listen("tcp", address)
+}
+
+func logEvent(event goQemu.Event) {
+	switch event.Type {
+	case goQemu.EventWarning:
+		slog.Warn(event.Message, "vmid", event.VMID, "error", event.Error)
+	case goQemu.EventLifecycle:
+		slog.Info("VM state changed", "vmid", event.VMID, "from", event.From, "to", event.To, "reason", event.Message)
+	case goQemu.EventInfo:
+		slog.Info(event.Message, "vmid", event.VMID)
+	}
+}
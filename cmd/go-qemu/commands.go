@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	goQemu "github.com/pardnchiu/go-qemu"
+)
+
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func runCreate(ctx context.Context, q *goQemu.Qemu, args []string) error {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+
+	accel := "kvm"
+	if runtime.GOOS == "darwin" {
+		accel = "hvf"
+	}
+
+	var networks stringList
+	id := fs.Int("id", 0, "VMID, assigned automatically when 0")
+	osName := fs.String("os", "", "debian, ubuntu, centos, rockylinux or almalinux")
+	version := fs.String("version", "", "OS version, e.g. 12 or 24.04")
+	hostname := fs.String("hostname", "", "hostname, defaults to <os>-<vmid>.vm")
+	memory := fs.Int("memory", 2048, "memory in MB")
+	cpus := fs.Int("cpus", 2, "number of vCPUs")
+	diskSize := fs.String("disk-size", "16G", "disk size passed to qemu-img resize")
+	accelerator := fs.String("accel", accel, "QEMU accelerator")
+	bios := fs.String("bios", "", "seabios (default) or ovmf")
+	var sshKeys, importKeys stringList
+	fs.Var(&sshKeys, "ssh-key", "authorized key or path to a public key file, repeatable")
+	fs.Var(&importKeys, "import-key", "gh:<name> to import that user's GitHub keys, repeatable")
+	restart := fs.String("restart", "", "restart policy: never, on-failure or always")
+	onBoot := fs.Bool("onboot", false, "start on host boot")
+	fs.Var(&networks, "network", "network definition, repeatable (bridge=vmbr0,model=virtio-net-pci,...)")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *osName == "" || *version == "" {
+		return usageErrorf("-os and -version are required")
+	}
+
+	var keys []string
+	for _, key := range sshKeys {
+		if data, err := os.ReadFile(expandHome(key)); err == nil {
+			key = strings.TrimSpace(string(data))
+		}
+		keys = append(keys, key)
+	}
+
+	config := goQemu.Config{
+		ID:          *id,
+		Hostname:    *hostname,
+		Accelerator: *accelerator,
+		Memory:      *memory,
+		CPUs:        *cpus,
+		BIOS:        *bios,
+		DiskSize:    *diskSize,
+		OS:          *osName,
+		Version:     *version,
+		Network:     parseNetworks(networks),
+		Restart:     goQemu.RestartPolicy{Policy: *restart},
+		OnBoot:      *onBoot,
+		CloudInit:   goQemu.CloudInit{ImportKeys: importKeys},
+	}
+
+	instance, err := q.CreateInstanceContext(ctx, config, strings.Join(keys, "\n"))
+	if err != nil {
+		return err
+	}
+
+	// * generated passwords are only saved as a hash, this is the one chance to see it
+	if instance.Password != "" {
+		fmt.Printf("password for %s: %s\n", instance.Config.CloudInit.Username, instance.Password)
+	}
+	return nil
+}
+
+func runUpdate(ctx context.Context, q *goQemu.Qemu, args []string) error {
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+
+	var networks stringList
+	hostname := fs.String("hostname", "", "hostname")
+	memory := fs.Int("memory", 0, "memory in MB")
+	cpus := fs.Int("cpus", 0, "number of vCPUs")
+	bios := fs.String("bios", "", "seabios or ovmf")
+	restart := fs.String("restart", "", "restart policy: never, on-failure or always")
+	onBoot := fs.Bool("onboot", false, "start on host boot")
+	fs.Var(&networks, "network", "network definition, repeatable, replaces all networks")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	vmid, err := parseVMID(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	instance, err := q.GetContext(ctx, vmid)
+	if err != nil {
+		return err
+	}
+
+	// * only flags given on the command line are changed
+	var patch goQemu.ConfigPatch
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "hostname":
+			patch.Hostname = hostname
+		case "memory":
+			patch.Memory = memory
+		case "cpus":
+			patch.CPUs = cpus
+		case "bios":
+			patch.BIOS = bios
+		case "restart":
+			policy := instance.Config.Restart
+			policy.Policy = *restart
+			patch.Restart = &policy
+		case "onboot":
+			patch.OnBoot = onBoot
+		case "network":
+			patch.Network = parseNetworks(networks)
+		}
+	})
+
+	instance, err = q.UpdateContext(ctx, vmid, patch)
+	if err != nil {
+		return err
+	}
+
+	if len(instance.Pending) > 0 {
+		fmt.Printf("pending restart: %s\n", strings.Join(instance.Pending, ", "))
+	}
+	return nil
+}
+
+func runRevert(ctx context.Context, q *goQemu.Qemu, args []string) error {
+	vmid, err := parseVMID(args)
+	if err != nil {
+		return err
+	}
+
+	instance, err := q.RevertContext(ctx, vmid)
+	if err != nil {
+		return err
+	}
+
+	if len(instance.Pending) > 0 {
+		fmt.Printf("pending restart: %s\n", strings.Join(instance.Pending, ", "))
+	}
+	return nil
+}
+
+func runShutdown(ctx context.Context, q *goQemu.Qemu, args []string) error {
+	fs := flag.NewFlagSet("shutdown", flag.ContinueOnError)
+	timeout := fs.Duration("timeout", 180*time.Second, "time to wait before forcing stop")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	vmid, err := parseVMID(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	return q.ShutdownContext(ctx, vmid, *timeout)
+}
+
+func runList(ctx context.Context, q *goQemu.Qemu, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print JSON")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	vms := q.ListContext(ctx)
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(vms)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VMID\tHOSTNAME\tSTATUS\tLOCK\tPID\tOS\tMEMORY\tCPUS\tVNC")
+	for _, vm := range vms {
+		pid := "-"
+		if vm.PID > 0 {
+			pid = fmt.Sprintf("%d", vm.PID)
+		}
+		lock := "-"
+		if vm.Lock != nil {
+			lock = vm.Lock.Operation
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s %s\t%dM\t%d\t%d\n",
+			vm.Config.ID,
+			vm.Config.Hostname,
+			vm.Status,
+			lock,
+			pid,
+			vm.Config.OS,
+			vm.Config.Version,
+			vm.Config.Memory,
+			vm.Config.CPUs,
+			vm.Config.VNCPort,
+		)
+	}
+
+	return w.Flush()
+}
+
+func runVNC(ctx context.Context, q *goQemu.Qemu, args []string) error {
+	vmid, err := parseVMID(args)
+	if err != nil {
+		return err
+	}
+
+	url, err := q.VNCAddressContext(ctx, vmid)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(url)
+	return nil
+}
+
+func runSystemdUnit(ctx context.Context, q *goQemu.Qemu, args []string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(q.SystemdUnit(executable))
+	return nil
+}
+
+func parseNetworks(values []string) []goQemu.Network {
+	var networks []goQemu.Network
+	for _, value := range values {
+		networks = append(networks, goQemu.ParseNetwork(value))
+	}
+	return networks
+}
+
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
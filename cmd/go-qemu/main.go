@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+
+	goQemu "github.com/pardnchiu/go-qemu"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, q *goQemu.Qemu, args []string) error
+}
+
+var commands = map[string]command{
+	"create":       {"create [flags]", runCreate},
+	"start":        {"start <vmid>", vmidCommand((*goQemu.Qemu).StartContext)},
+	"stop":         {"stop <vmid>", vmidCommand((*goQemu.Qemu).StopContext)},
+	"shutdown":     {"shutdown [-timeout 180] <vmid>", runShutdown},
+	"pause":        {"pause <vmid>", vmidCommand((*goQemu.Qemu).PauseContext)},
+	"resume":       {"resume <vmid>", vmidCommand((*goQemu.Qemu).ResumeContext)},
+	"reset":        {"reset <vmid>", vmidCommand((*goQemu.Qemu).ResetContext)},
+	"reboot":       {"reboot <vmid>", vmidCommand((*goQemu.Qemu).RebootContext)},
+	"delete":       {"delete <vmid>", vmidCommand((*goQemu.Qemu).DeleteContext)},
+	"update":       {"update [flags] <vmid>", runUpdate},
+	"revert":       {"revert <vmid>", runRevert},
+	"list":         {"list [-json]", runList},
+	"vnc":          {"vnc <vmid>", runVNC},
+	"cleanup":      {"cleanup", func(ctx context.Context, q *goQemu.Qemu, args []string) error { return q.CleanupContext(ctx) }},
+	"start-all":    {"start-all", func(ctx context.Context, q *goQemu.Qemu, args []string) error { return q.StartAllContext(ctx) }},
+	"stop-all":     {"stop-all", func(ctx context.Context, q *goQemu.Qemu, args []string) error { return q.StopAllContext(ctx) }},
+	"systemd-unit": {"systemd-unit", runSystemdUnit},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], openQemu))
+}
+
+// * exit code 0 on success, 1 when the command failed, 2 on a usage error
+func run(args []string, open func() (*goQemu.Qemu, error)) int {
+	if len(args) < 1 {
+		usage()
+		return 2
+	}
+
+	name := args[0]
+	if name == "help" || name == "-h" || name == "--help" {
+		usage()
+		return 0
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+		usage()
+		return 2
+	}
+
+	qemu, err := open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	// * Ctrl-C cancels downloads and monitor calls instead of killing mid-write
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = cmd.run(ctx, qemu, args[1:])
+	stop()
+	qemu.Close()
+
+	var usageErr *usageError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(os.Stderr, "error: %v\nusage: go-qemu %s\n", err, cmd.usage)
+		return 2
+	default:
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+}
+
+// * keep stdout clean for -json and the VNC address
+func openQemu() (*goQemu.Qemu, error) {
+	return goQemu.NewQemu(
+		goQemu.WithEnv(),
+		goQemu.WithObserver(goQemu.NewConsoleObserver(os.Stderr)),
+	)
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: go-qemu <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+func vmidCommand(fn func(*goQemu.Qemu, context.Context, int) error) func(context.Context, *goQemu.Qemu, []string) error {
+	return func(ctx context.Context, q *goQemu.Qemu, args []string) error {
+		vmid, err := parseVMID(args)
+		if err != nil {
+			return err
+		}
+		return fn(q, ctx, vmid)
+	}
+}
+
+func parseVMID(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, usageErrorf("expected exactly one VMID")
+	}
+
+	vmid, err := strconv.Atoi(args[0])
+	if err != nil || vmid <= 0 {
+		return 0, usageErrorf("invalid VMID: %s", args[0])
+	}
+
+	return vmid, nil
+}
+
+// * bad arguments, exit code 2 like the flag package
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *usageError) Unwrap() error {
+	return e.err
+}
+
+func usageErrorf(format string, args ...any) error {
+	return &usageError{err: fmt.Errorf(format, args...)}
+}
+
+// * the flag set already printed the error and its defaults
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{err: err}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"testing"
+
+	goQemu "github.com/pardnchiu/go-qemu"
+)
+
+func TestRun(t *testing.T) {
+	path := t.TempDir()
+	open := func() (*goQemu.Qemu, error) {
+		return goQemu.NewQemu(goQemu.WithPath(path), goQemu.WithBinary("/bin/true"))
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		expect int
+	}{
+		{"no command", nil, 2},
+		{"help", []string{"help"}, 0},
+		{"unknown command", []string{"bogus"}, 2},
+		{"missing VMID", []string{"start"}, 2},
+		{"invalid VMID", []string{"start", "abc"}, 2},
+		{"zero VMID", []string{"stop", "0"}, 2},
+		{"extra argument", []string{"delete", "101", "102"}, 2},
+		{"VM not found", []string{"start", "101"}, 1},
+		{"shutdown help", []string{"shutdown", "-h"}, 0},
+		{"shutdown bad timeout", []string{"shutdown", "-timeout", "soon", "101"}, 2},
+		{"shutdown not found", []string{"shutdown", "-timeout", "1s", "101"}, 1},
+		{"create unknown flag", []string{"create", "-bogus"}, 2},
+		{"create without version", []string{"create", "-os", "debian"}, 2},
+		{"update bad memory", []string{"update", "-memory", "lots", "101"}, 2},
+		{"update without VMID", []string{"update", "-memory", "4096"}, 2},
+		{"update not found", []string{"update", "-memory", "4096", "101"}, 1},
+		{"list", []string{"list", "-json"}, 0},
+		{"cleanup", []string{"cleanup"}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := run(tt.args, open); code != tt.expect {
+				t.Errorf("Expected exit code %d for %v, got %d", tt.expect, tt.args, code)
+			}
+		})
+	}
+}
+
+func TestRun_OpenError(t *testing.T) {
+	open := func() (*goQemu.Qemu, error) {
+		return nil, errors.New("no qemu")
+	}
+	if code := run([]string{"list"}, open); code != 1 {
+		t.Errorf("Expected exit code 1, got %d", code)
+	}
+}
+
+func TestParseVMID(t *testing.T) {
+	tests := []struct {
+		args   []string
+		expect int
+		usage  bool
+	}{
+		{[]string{"101"}, 101, false},
+		{nil, 0, true},
+		{[]string{"101", "102"}, 0, true},
+		{[]string{"-1"}, 0, true},
+		{[]string{"vm101"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		vmid, err := parseVMID(tt.args)
+		var usageErr *usageError
+		if vmid != tt.expect || errors.As(err, &usageErr) != tt.usage {
+			t.Errorf("parseVMID(%v) = %d, %v", tt.args, vmid, err)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		args   []string
+		expect error
+		usage  bool
+	}{
+		{[]string{"-memory", "4096", "101"}, nil, false},
+		{[]string{"-h"}, flag.ErrHelp, false},
+		{[]string{"-memory", "lots"}, nil, true},
+		{[]string{"-bogus"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("update", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.Int("memory", 0, "memory in MB")
+
+		err := parseFlags(fs, tt.args)
+		var usageErr *usageError
+		if errors.As(err, &usageErr) != tt.usage || (!tt.usage && !errors.Is(err, tt.expect)) {
+			t.Errorf("parseFlags(%v) = %v", tt.args, err)
+		}
+	}
+}
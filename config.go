@@ -1,30 +1,36 @@
 package goQemu
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"strconv"
 )
 
-func (q *Qemu) verifyConfig(config Config) (*Config, error) {
-	vmidStart, err := strconv.Atoi(os.Getenv("GO_QEMU_VMID_START"))
+func (q *Qemu) verifyConfig(ctx context.Context, config Config) (*Config, error) {
+	checked, err := q.checkConfig(config)
 	if err != nil {
-		vmidStart = 100
+		return nil, err
 	}
+	config = *checked
 
-	vmidEnd, err := strconv.Atoi(os.Getenv("GO_QEMU_VMID_END"))
-	if err != nil {
-		vmidEnd = 999
+	if _, err := q.ensureCloudInit(ctx, &config); err != nil {
+		return nil, fmt.Errorf("failed to generate cloud-init: %w", err)
 	}
 
+	return &config, nil
+}
+
+// * validation and defaults only, no side effects
+func (q *Qemu) checkConfig(config Config) (*Config, error) {
+	vmidStart, vmidEnd := q.vmidRange()
+
 	if config.ID == 0 {
-		return nil, fmt.Errorf("VMID must be specified")
+		return nil, configError("id", "VMID must be specified")
 	} else if config.ID < vmidStart || config.ID > vmidEnd {
-		return nil, fmt.Errorf("VMID must be between %d and %d", vmidStart, vmidEnd)
+		return nil, configError("id", "VMID must be between %d and %d", vmidStart, vmidEnd)
 	}
 
 	if config.Hostname == "" {
-		return nil, fmt.Errorf("hostname must be specified")
+		return nil, configError("hostname", "hostname must be specified")
 	}
 
 	// if config.Username == "" {
@@ -32,11 +38,24 @@ func (q *Qemu) verifyConfig(config Config) (*Config, error) {
 	// }
 
 	if config.Options.UUID == "" {
-		return nil, fmt.Errorf("UUID must be specified")
+		return nil, configError("options.uuid", "UUID must be specified")
 	}
 
-	if config.DiskPath == "" {
-		return nil, fmt.Errorf("disk_path must be specified")
+	if len(config.Disks) == 0 {
+		return nil, configError("disks", "at least one disk must be specified")
+	}
+	for i := range config.Disks {
+		disk := &config.Disks[i]
+		if disk.Path == "" {
+			return nil, configError(fmt.Sprintf("disks[%d].path", i), "disk path must be specified")
+		}
+		switch disk.Format {
+		case "":
+			disk.Format = "qcow2"
+		case "qcow2", "raw":
+		default:
+			return nil, configError(fmt.Sprintf("disks[%d].format", i), "unsupported disk format: %s", disk.Format)
+		}
 	}
 
 	// if config.BIOSPath == "" {
@@ -50,45 +69,28 @@ func (q *Qemu) verifyConfig(config Config) (*Config, error) {
 
 	config.VNCPort = 59000 + config.ID
 
-	if len(config.Network) == 0 {
-		// config.Network = []Network{
-		// 	{
-		// 		Bridge:     "vmbr0",
-		// 		Model:      "virtio-net-pci",
-		// 		Vlan:       0,
-		// 		MACAddress: generateMAC(config.ID),
-		// 		Firewall:   false,
-		// 		Disconnect: false,
-		// 		MTU:        1500,
-		// 		RateLimit:  0,
-		// 		Multiqueue: 0,
-		// 	},
-		// }
-		config.Network = []string{
-			"bridge=vmbr0,model=virtio-net-pci,vlan=0,mac_address=" + generateMAC(config.ID) + ",firewall=0,disconnect=0,mtu=1500,rate_limit=0,multiqueue=0",
-		}
+	switch config.Restart.Policy {
+	case "":
+		config.Restart.Policy = RestartNever
+	case RestartNever, RestartOnFailure, RestartAlways:
+	default:
+		return nil, configError("restart.policy", "unsupported restart policy: %s", config.Restart.Policy)
 	}
 
-	cloudInitConfig := config.CloudInit
-	// if config.CloudInitPath == "" && config.OS != "" {
-	// 	cloudInitConfig = CloudInit{
-	// 		UUID: config.UUID,
-	// 		// OS:               config.OS,
-	// 		Hostname:         config.Hostname,
-	// 		Username:         config.Username,
-	// 		Password:         config.Password,
-	// 		SSHAuthorizedKey: config.SSHAuthorizedKey,
-	// 		UpgradePackages:  true,
-	// 		NetworkConfig:    nil,
-	// 	}
-	// }
+	if config.Restart.MaxRetries < 0 || config.Restart.Backoff < 0 {
+		return nil, configError("restart", "restart max_retries and backoff must not be negative")
+	}
 
-	cloudInitPath, err := q.generateCloudInit(config, cloudInitConfig)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate cloud-init: %w", err)
+	if len(config.Network) == 0 {
+		config.Network = []Network{
+			{
+				Bridge:     "vmbr0",
+				Model:      "virtio-net-pci",
+				MACAddress: generateMAC(config.ID),
+				MTU:        1500,
+			},
+		}
 	}
-	config.CloudInit = cloudInitConfig
-	config.CloudInitPath = cloudInitPath
 
 	return &config, nil
 }
@@ -1,8 +1,9 @@
 package goQemu
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -12,25 +13,68 @@ import (
 	"github.com/google/uuid"
 )
 
-// TODO: append ssh string for cloud-init config
+// * ssh holds the default user's authorized keys, one per line
 func (q *Qemu) Create(config Config, ssh string) error {
-	q.Cleanup()
+	return q.CreateContext(context.Background(), config, ssh)
+}
+
+func (q *Qemu) CreateContext(ctx context.Context, config Config, ssh string) error {
+	_, err := q.CreateInstanceContext(ctx, config, ssh)
+	return err
+}
+
+func (q *Qemu) CreateInstance(config Config, ssh string) (*Instance, error) {
+	return q.CreateInstanceContext(context.Background(), config, ssh)
+}
 
-	// assign VMID if not provided
+// * cancelling ctx aborts the download, disk copy and cloud-init ISO generation
+func (q *Qemu) CreateInstanceContext(ctx context.Context, config Config, ssh string) (*Instance, error) {
+	return q.createInstance(ctx, config, ssh)
+}
+
+// * no reconcile pass here, it only touches VMs with a config and a new VMID has none
+func (q *Qemu) createInstance(ctx context.Context, config Config, ssh string) (instance *Instance, err error) {
+	// assign VMID if not provided, locked until create returns
+	var unlock func()
 	if config.ID == 0 {
-		vmid, err := q.assignVMID()
+		var vmid int
+		vmid, ctx, unlock, err = q.reserveVMID(ctx, "create")
 		if err != nil {
-			return fmt.Errorf("failed to assign VMID: %w", err)
+			return nil, fmt.Errorf("failed to assign VMID: %w", err)
 		}
 		config.ID = vmid
+	} else {
+		ctx, unlock, err = q.lock(ctx, config.ID, "create")
+		if errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("VMID %d is %w: %w", config.ID, ErrVMIDInUse, err)
+		} else if err != nil {
+			return nil, err
+		}
 	}
+	defer unlock()
 
 	// check if VMID already exists
-	_, configBody, err := q.getFile(q.Folder.Config, config.ID)
-	if err == nil && configBody != "" {
-		return fmt.Errorf("VMID %d already exists", config.ID)
+	if _, err := q.storage().Get(KindConfig, strconv.Itoa(config.ID)); err == nil {
+		return nil, fmt.Errorf("VMID %d is %w", config.ID, ErrVMIDInUse)
 	}
 
+	if task := taskFrom(ctx); task != nil {
+		task.setVMID(config.ID)
+	}
+
+	// * every stage registers its undo, a failure unwinds them in reverse
+	rb := &rollback{}
+	defer func() {
+		if err != nil {
+			q.abortCreate(ctx, config.ID, rb, err)
+		}
+	}()
+
+	q.setState(config.ID, StatusCreating, "create requested", nil)
+	rb.add("state", func() error {
+		return q.deleteState(config.ID)
+	})
+
 	if config.OS != "" && config.Version != "" {
 		if config.Hostname == "" {
 			config.Hostname = fmt.Sprintf("%s-%d.vm", config.OS, config.ID)
@@ -38,12 +82,13 @@ func (q *Qemu) Create(config Config, ssh string) error {
 
 		img, err := q.getOSImageInfo(config.OS, config.Version)
 		if err != nil {
-			return fmt.Errorf("failed to get OS image info: %w", err)
+			return nil, fmt.Errorf("failed to get OS image info: %w", err)
 		}
 
-		imagePath, err := q.downloadOSImage(img)
+		setPhase(ctx, "download image")
+		imagePath, err := q.downloadOSImage(ctx, img)
 		if err != nil {
-			return fmt.Errorf("failed to download image: %w", err)
+			return nil, fmt.Errorf("failed to download image: %w", err)
 		}
 
 		diskSize := config.DiskSize
@@ -51,14 +96,18 @@ func (q *Qemu) Create(config Config, ssh string) error {
 			diskSize = "16G"
 		}
 
-		diskPath, err := q.generateVMDisk(config.ID, imagePath, diskSize)
+		setPhase(ctx, "prepare disk")
+		diskPath, err := q.generateVMDisk(ctx, config.ID, imagePath, diskSize)
 		if err != nil {
-			return fmt.Errorf("failed to generate VM disk: %w", err)
+			return nil, fmt.Errorf("failed to generate VM disk: %w", err)
 		}
 
-		config.DiskPath = diskPath
+		config.Disks = []Disk{{Path: diskPath, Format: "qcow2"}}
+		rb.add("disk "+diskPath, func() error {
+			return os.Remove(diskPath)
+		})
 	} else {
-		return fmt.Errorf("either disk_path or (os and version) must be specified")
+		return nil, configError("os", "os and version must be specified")
 	}
 
 	username := config.OS
@@ -68,40 +117,157 @@ func (q *Qemu) Create(config Config, ssh string) error {
 		username = "alma"
 	}
 
-	passwd := "passwd"
-
+	var generated string
 	if config.Options.UUID == "" {
 		config.Options = Options{
 			UUID: uuid.New().String(),
 		}
 
-		config.CloudInit = CloudInit{
-			Hostname:        config.Hostname,
-			Username:        username,
-			Password:        passwd,
-			AuthorizedKey:   ssh,
-			UpgradePackages: true,
-			IPv4:            "mode=dhcp,address=,gateway=",
-			IPv6:            "mode=dhcp,address=,gateway=",
+		// * defaults for what the caller left empty, users, packages and the like are kept
+		cloudInit := &config.CloudInit
+		if cloudInit.Hostname == "" {
+			cloudInit.Hostname = config.Hostname
+		}
+		if cloudInit.Username == "" {
+			cloudInit.Username = username
+		}
+		// * the default password, or a random one returned once in Instance.Password
+		if cloudInit.Password == "" && cloudInit.PasswordHash == "" && len(cloudInit.Users) == 0 {
+			cloudInit.Password = q.vmPassword()
+			if cloudInit.Password == "" {
+				if generated, err = randomString(passwordAlphabet, randomPasswordLength); err != nil {
+					return nil, err
+				}
+				cloudInit.Password = generated
+			}
 		}
+		if ssh != "" {
+			cloudInit.AuthorizedKey = ssh
+		}
+		cloudInit.UpgradePackages = true
+		if cloudInit.IPv4 == "" {
+			cloudInit.IPv4 = "mode=dhcp,address=,gateway="
+		}
+		if cloudInit.IPv6 == "" {
+			cloudInit.IPv6 = "mode=dhcp,address=,gateway="
+		}
+	}
+
+	setPhase(ctx, "import SSH keys")
+	if err := q.importSSHKeys(ctx, &config.CloudInit); err != nil {
+		return nil, err
+	}
+	if err := sealPasswords(&config.CloudInit); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	verifyConfig, err := q.verifyConfig(config)
+	setPhase(ctx, "generate cloud-init")
+	rb.add("cloud-init ISO", func() error {
+		q.removeCloudInit(config.ID)
+		return nil
+	})
+	verifyConfig, err := q.verifyConfig(ctx, config)
 	if err != nil {
-		return fmt.Errorf("invalid config: %w", err)
+		return nil, err
 	}
 
-	if err := q.saveConfig(*verifyConfig); err != nil {
-		return fmt.Errorf("failed to save config: %w", err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	pid, err := q.runVM(verifyConfig, verifyConfig.ID)
+	if err := q.saveConfig(*verifyConfig); err != nil {
+		return nil, fmt.Errorf("failed to save config: %w", err)
+	}
+	rb.add("config", func() error {
+		return q.deleteConfig(config.ID)
+	})
+
+	setPhase(ctx, "start VM")
+	rb.add("log", func() error {
+		return os.Remove(filepath.Join(q.Folder.Log, fmt.Sprintf("%d.log", config.ID)))
+	})
+	pid, err := q.runVM(ctx, verifyConfig, verifyConfig.ID)
 	if err != nil {
+		return nil, err
+	}
+	rb.add("VM process", func() error {
+		err := q.StopContext(context.WithoutCancel(ctx), config.ID)
+		if errors.Is(err, ErrNotRunning) {
+			return nil
+		}
 		return err
+	})
+
+	q.infof(verifyConfig.ID, "VM %d created with PID %d", verifyConfig.ID, pid)
+	if instance, err = q.GetContext(ctx, verifyConfig.ID); err != nil {
+		return nil, err
 	}
+	instance.Password = generated
+	return instance, nil
+}
+
+type rollback struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	name string
+	undo func() error
+}
 
-	fmt.Printf("[*] VM %d created with PID %d\n", verifyConfig.ID, pid)
-	return nil
+func (r *rollback) add(name string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{name: name, undo: undo})
+}
+
+func (r *rollback) names() []string {
+	names := make([]string, len(r.steps))
+	for i, step := range r.steps {
+		names[i] = step.name
+	}
+	return names
+}
+
+// * newest first, keeps going past failures
+func (r *rollback) run() error {
+	var errs []error
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		if err := step.undo(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("%s: %w", step.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (q *Qemu) abortCreate(ctx context.Context, vmid int, rb *rollback, cause error) {
+	task := taskFrom(ctx)
+
+	if q.keepArtifacts {
+		q.setState(vmid, StatusStopped, "create failed", func(s *State) {
+			s.ExitReason = cause.Error()
+		})
+		q.warn(vmid, "create failed, artifacts kept: "+strings.Join(rb.names(), ", "), cause)
+		if task != nil {
+			task.Logf("artifacts kept: %s", strings.Join(rb.names(), ", "))
+		}
+		return
+	}
+
+	if task != nil {
+		task.Logf("rolling back: %s", strings.Join(rb.names(), ", "))
+	}
+	if err := rb.run(); err != nil {
+		q.warn(vmid, "create rollback incomplete", err)
+		if task != nil {
+			task.Logf("rollback incomplete: %v", err)
+		}
+		return
+	}
+	q.infof(vmid, "create of VM %d rolled back", vmid)
 }
 
 func (q *Qemu) verifyArgs(config Config) []string {
@@ -150,27 +316,44 @@ func (q *Qemu) verifyArgs(config Config) []string {
 		"-audiodev", "none,id=audio0",
 		"-device", "intel-hda",
 		"-device", "hda-duplex,audiodev=audio0",
-		"-drive", fmt.Sprintf("file=%s,format=qcow2,if=virtio", config.DiskPath),
-		"-drive", fmt.Sprintf("file=%s,format=raw,media=cdrom,readonly=on", config.CloudInitPath),
+	}
+
+	// * boot disk first, then the cloud-init ISO unless the seed server is used
+	for _, disk := range config.Disks {
+		args = append(args, "-drive", fmt.Sprintf("file=%s,format=%s,if=virtio", disk.Path, disk.Format))
+	}
+
+	smbios := fmt.Sprintf("type=1,uuid=%s", config.Options.UUID)
+	if q.seedURL != "" {
+		smbios += ",serial=" + q.seedSerial(config)
+	} else {
+		args = append(args, "-drive", fmt.Sprintf("file=%s,format=raw,media=cdrom,readonly=on", config.CloudInitPath))
+	}
+
+	args = append(args,
 		"-rtc", "base=utc,clock=host",
 		"-vnc", fmt.Sprintf("0.0.0.0:%d,password=on", vncDisplay),
 		"-monitor", fmt.Sprintf("unix:%s,server,nowait", monitorPath),
+		"-qmp", fmt.Sprintf("unix:%s,server,nowait", q.qmpPath(config.ID)),
+		"-qmp", fmt.Sprintf("unix:%s,server,nowait", q.eventPath(config.ID)),
+		"-chardev", fmt.Sprintf("socket,id=qga0,path=%s,server=on,wait=off", q.qgaPath(config.ID)),
+		"-device", "virtio-serial",
+		"-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
 		// "-chardev", fmt.Sprintf("socket,id=mon0,path=%s,server=on,wait=off", monitorPath),
 		// "-mon", "chardev=mon0,mode=control",
 		// "-netdev", fmt.Sprintf("user,id=net0,hostfwd=tcp::%d-:22", config.SSHPort),
 		// "-device", "virtio-net-pci,netdev=net0",
 
-		"-smbios", fmt.Sprintf("type=1,uuid=%s", config.Options.UUID),
+		"-device", "virtio-balloon-pci,id=balloon0", // * lowers memory live on Update
+		"-smbios", smbios,
 		"-device", "virtio-gpu-pci",
 		// "-display", "none",
 		// "-nographic",
 		// "-display", "cocoa,show-cursor=on",
 		// "-serial", "null", // Disable serial console
-	}
+	)
 
-	for i, e := range config.Network {
-		net := getNetwork(e)
-		slog.Info("Parsed network", "value", e, "network", net)
+	for i, net := range config.Network {
 		if net.Disconnect {
 			continue
 		}
@@ -193,39 +376,43 @@ func (q *Qemu) verifyArgs(config Config) []string {
 		args = append(args, "-device", deviceArgs)
 	}
 
-	slog.Info("config", "arg", args)
+	q.log().Info("config", "arg", args)
 
 	return args
 }
 
 func (q *Qemu) assignVMID() (int, error) {
-	ids, err := os.ReadDir(q.Folder.Config)
+	ary, err := q.usedVMIDs()
 	if err != nil {
-		return 0, fmt.Errorf("failed to read go-qemu/configs: %w", err)
+		return 0, err
 	}
 
-	ary := make(map[int]bool, len(ids))
-	for _, id := range ids {
-		if id.IsDir() {
-			continue
+	start, end := q.vmidRange()
+	for id := start; id <= end; id++ {
+		if !ary[id] {
+			return id, nil
 		}
+	}
 
-		var vmid int
-		if _, err := fmt.Sscanf(id.Name(), "%d.json", &vmid); err == nil {
-			ary[vmid] = true
-		}
+	return 0, ErrNoVMIDAvailable
+}
+
+func (q *Qemu) usedVMIDs() (map[int]bool, error) {
+	ids, err := q.configIDs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configs: %w", err)
 	}
 
-	for id := 100; id <= 999; id++ {
-		if !ary[id] {
-			return id, nil
-		}
+	ary := make(map[int]bool, len(ids))
+	for _, vmid := range ids {
+		ary[vmid] = true
 	}
 
-	return 0, fmt.Errorf("no available VMID can be assigned")
+	return ary, nil
 }
 
-func getNetwork(value string) Network {
+// * "bridge=vmbr0,model=virtio-net-pci,..." as used by the CLI and schema 0 configs
+func ParseNetwork(value string) Network {
 	network := Network{MTU: 1500}
 
 	pairs := strings.Split(value, ",")
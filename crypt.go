@@ -0,0 +1,154 @@
+package goQemu
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// * SHA-512 crypt ($6$) as glibc implements it, what cloud-init passes to chpasswd -e
+// * and useradd -p; see https://www.akkadia.org/drepper/SHA-crypt.txt
+const (
+	cryptAlphabet        = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	cryptDefaultRounds   = 5000
+	cryptSaltLength      = 16
+	passwordAlphabet     = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	vncPasswordLength    = 8 // * VNC only uses the first 8 characters
+	randomPasswordLength = 16
+)
+
+// * byte order of the final encoding, three bytes per group
+var cryptPermutation = [21][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+	{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+	{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+}
+
+// * rounds 0 uses the default and leaves it out of the hash
+func sha512Crypt(password, salt string, rounds int) string {
+	if len(salt) > cryptSaltLength {
+		salt = salt[:cryptSaltLength]
+	}
+	prefix := "$6$"
+	if rounds == 0 {
+		rounds = cryptDefaultRounds
+	} else {
+		rounds = min(max(rounds, 1000), 999999999)
+		prefix += fmt.Sprintf("rounds=%d$", rounds)
+	}
+
+	p, s := []byte(password), []byte(salt)
+
+	alt := sha512.New()
+	alt.Write(p)
+	alt.Write(s)
+	alt.Write(p)
+	b := alt.Sum(nil)
+
+	a := sha512.New()
+	a.Write(p)
+	a.Write(s)
+	for i := len(p); i > 0; i -= 64 {
+		a.Write(b[:min(i, 64)])
+	}
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(b)
+		} else {
+			a.Write(p)
+		}
+	}
+	c := a.Sum(nil)
+
+	dp := sha512.New()
+	for range p {
+		dp.Write(p)
+	}
+	pSeq := repeatTo(dp.Sum(nil), len(p))
+
+	ds := sha512.New()
+	for range 16 + int(c[0]) {
+		ds.Write(s)
+	}
+	sSeq := repeatTo(ds.Sum(nil), len(s))
+
+	for r := range rounds {
+		h := sha512.New()
+		if r&1 != 0 {
+			h.Write(pSeq)
+		} else {
+			h.Write(c)
+		}
+		if r%3 != 0 {
+			h.Write(sSeq)
+		}
+		if r%7 != 0 {
+			h.Write(pSeq)
+		}
+		if r&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pSeq)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(prefix + salt + "$")
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for range n {
+			out.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for _, group := range cryptPermutation {
+		encode(c[group[0]], c[group[1]], c[group[2]], 4)
+	}
+	encode(0, 0, c[63], 2)
+
+	return out.String()
+}
+
+func repeatTo(digest []byte, length int) []byte {
+	seq := make([]byte, 0, length)
+	for len(seq) < length {
+		seq = append(seq, digest[:min(len(digest), length-len(seq))]...)
+	}
+	return seq
+}
+
+func hashPassword(password string) (string, error) {
+	salt, err := randomString(cryptAlphabet, cryptSaltLength)
+	if err != nil {
+		return "", err
+	}
+	return sha512Crypt(password, salt, 0), nil
+}
+
+// * stable salt for a password that reaches rendering unhashed, so the same
+// * config keeps rendering the same user-data and the ISO is not rebuilt
+func stableSalt(seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	salt := make([]byte, cryptSaltLength)
+	for i := range salt {
+		salt[i] = cryptAlphabet[int(sum[i])%len(cryptAlphabet)]
+	}
+	return string(salt)
+}
+
+func randomString(alphabet string, length int) (string, error) {
+	limit := big.NewInt(int64(len(alphabet)))
+	value := make([]byte, length)
+	for i := range value {
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate random string: %w", err)
+		}
+		value[i] = alphabet[n.Int64()]
+	}
+	return string(value), nil
+}
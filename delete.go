@@ -1,41 +1,87 @@
 package goQemu
 
 import (
-	"log/slog"
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"strconv"
 	"time"
 )
 
 func (q *Qemu) Delete(vmid int) error {
-	_, err := q.loadConfig(vmid)
+	return q.DeleteContext(context.Background(), vmid)
+}
+
+// * removes whatever is left of the VM, ErrNotFound only when nothing was found
+func (q *Qemu) DeleteContext(ctx context.Context, vmid int) error {
+	ctx, unlock, err := q.lock(ctx, vmid, "delete")
 	if err != nil {
-		slog.Error("Failed to get VM config", "vmid", vmid, "error", err)
+		return err
+	}
+	defer unlock()
+
+	var errs []error
+	found := false
+
+	remove := func(path string) {
+		found = true
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
 	}
 
 	if pidFilePath, _, err := q.getFile(q.Folder.PID, vmid); err == nil {
-		q.Stop(vmid)
-		os.Remove(pidFilePath)
+		if err := q.StopContext(ctx, vmid); err != nil && !errors.Is(err, ErrNotRunning) && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to stop VM %d: %w", vmid, err)
+		}
+		remove(pidFilePath)
 	}
 
-	if configPath, _, err := q.getFile(q.Folder.Config, vmid); err == nil {
-		os.Remove(configPath)
+	if _, err := q.storage().Get(KindConfig, strconv.Itoa(vmid)); err == nil {
+		found = true
+		for _, key := range []string{strconv.Itoa(vmid), priorConfigKey(vmid)} {
+			if err := q.storage().Delete(KindConfig, key); err != nil {
+				errs = append(errs, err)
+			}
+		}
 	}
 
 	if diskPaths, err := q.diskPathAll(vmid); err == nil {
 		for _, path := range diskPaths {
-			slog.Info("Deleting disk file", "vmid", vmid, "path", path)
-			os.Remove(path)
+			q.log().Info("Deleting disk file", "vmid", vmid, "path", path)
+			remove(path)
 		}
 		q.removeCloudInit(vmid)
 	}
 
 	if logPath, _, err := q.getFile(q.Folder.Log, vmid); err == nil {
-		os.Remove(logPath)
+		remove(logPath)
 	}
+	os.Remove(q.vncPasswordPath(vmid))
 
-	time.Sleep(1 * time.Second)
+	if _, err := q.loadState(vmid); err == nil {
+		found = true
+		if err := q.deleteState(vmid); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("VM %d %w", vmid, ErrNotFound)
+	}
+
+	if err := sleepContext(ctx, 1*time.Second); err != nil {
+		return err
+	}
+
+	if err := q.CleanupContext(ctx); err != nil {
+		errs = append(errs, err)
+	}
 
-	q.Cleanup()
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to delete VM %d: %w", vmid, err)
+	}
 
 	return nil
 }
@@ -1,14 +1,16 @@
 package goQemu
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
-	"strings"
+	"time"
 )
 
 func isExists(ary []string, item string) bool {
@@ -21,14 +23,7 @@ func isExists(ary []string, item string) bool {
 }
 
 func (q *Qemu) getOSImageInfo(osName, version string) (*Image, error) {
-	var (
-		debianVersions = strings.Split(os.Getenv("GO_QEMU_DEBIAN_VERSION"), ",")
-		ubuntuVersions = strings.Split(os.Getenv("GO_QEMU_UBUNTU_VERSION"), ",")
-		centosVersions = strings.Split(os.Getenv("GO_QEMU_CENTOS_VERSION"), ",")
-		rockyVersions  = strings.Split(os.Getenv("GO_QEMU_ROCKYLINUX_VERSION"), ",")
-		almaVersions   = strings.Split(os.Getenv("GO_QEMU_ALMALINUX_VERSION"), ",")
-		img            Image
-	)
+	var img Image
 	img.OS = osName
 	img.Version = version
 
@@ -36,7 +31,7 @@ func (q *Qemu) getOSImageInfo(osName, version string) (*Image, error) {
 	switch arch {
 	case "amd64", "arm64":
 	default:
-		return nil, fmt.Errorf("unsupported architecture: %s", arch)
+		return nil, fmt.Errorf("%w: unsupported architecture: %s", ErrImageUnavailable, arch)
 	}
 
 	switch osName {
@@ -46,15 +41,15 @@ func (q *Qemu) getOSImageInfo(osName, version string) (*Image, error) {
 			"12": "bookworm",
 			"13": "trixie",
 		}
-		if !isExists(debianVersions, version) {
-			return nil, fmt.Errorf("unsupported version: Debian %s", version)
+		if !isExists(q.versions("debian"), version) {
+			return nil, fmt.Errorf("%w: unsupported version: Debian %s", ErrImageUnavailable, version)
 		}
 		versionName := versionNames[version]
 		img.URL = fmt.Sprintf("https://cloud.debian.org/images/cloud/%s/latest/debian-%s-generic-%s.qcow2", versionName, version, arch)
 		img.Filename = fmt.Sprintf("debian-%s-generic-%s.qcow2", version, arch)
 	case "ubuntu":
-		if !isExists(ubuntuVersions, version) {
-			return nil, fmt.Errorf("unsupported version: Ubuntu %s", version)
+		if !isExists(q.versions("ubuntu"), version) {
+			return nil, fmt.Errorf("%w: unsupported version: Ubuntu %s", ErrImageUnavailable, version)
 		}
 		img.URL = fmt.Sprintf("https://cloud-images.ubuntu.com/releases/%s/release/ubuntu-%s-server-cloudimg-%s.img", version, version, arch)
 		img.Filename = fmt.Sprintf("ubuntu-%s-server-cloudimg-%s.img", version, arch)
@@ -65,8 +60,8 @@ func (q *Qemu) getOSImageInfo(osName, version string) (*Image, error) {
 		case "amd64":
 			arch = "x86_64"
 		}
-		if !isExists(centosVersions, version) {
-			return nil, fmt.Errorf("unsupported version: CentOS %s", version)
+		if !isExists(q.versions("centos"), version) {
+			return nil, fmt.Errorf("%w: unsupported version: CentOS %s", ErrImageUnavailable, version)
 		}
 		img.URL = fmt.Sprintf("https://cloud.centos.org/centos/%s-stream/%s/images/CentOS-Stream-GenericCloud-%s-latest.%s.qcow2", version, arch, version, arch)
 		img.Filename = fmt.Sprintf("CentOS-Stream-GenericCloud-%s-latest.%s.qcow2", version, arch)
@@ -77,8 +72,8 @@ func (q *Qemu) getOSImageInfo(osName, version string) (*Image, error) {
 		case "amd64":
 			arch = "x86_64"
 		}
-		if !isExists(rockyVersions, version) {
-			return nil, fmt.Errorf("unsupported version: RockyLinux %s", version)
+		if !isExists(q.versions("rockylinux"), version) {
+			return nil, fmt.Errorf("%w: unsupported version: RockyLinux %s", ErrImageUnavailable, version)
 		}
 		img.URL = fmt.Sprintf("https://dl.rockylinux.org/pub/rocky/%s/images/%s/Rocky-%s-GenericCloud-Base.latest.%s.qcow2", version, arch, version, arch)
 		img.Filename = fmt.Sprintf("Rocky-%s-GenericCloud-Base.latest.%s.qcow2", version, arch)
@@ -89,98 +84,170 @@ func (q *Qemu) getOSImageInfo(osName, version string) (*Image, error) {
 		case "amd64":
 			arch = "x86_64"
 		}
-		if !isExists(almaVersions, version) {
-			return nil, fmt.Errorf("unsupported version: AlmaLinux %s", version)
+		if !isExists(q.versions("almalinux"), version) {
+			return nil, fmt.Errorf("%w: unsupported version: AlmaLinux %s", ErrImageUnavailable, version)
 		}
 		img.URL = fmt.Sprintf("https://repo.almalinux.org/almalinux/%s/cloud/%s/images/AlmaLinux-%s-GenericCloud-latest.%s.qcow2", version, arch, version, arch)
 		img.Filename = fmt.Sprintf("AlmaLinux-%s-GenericCloud-latest.%s.qcow2", version, arch)
 	default:
-		return nil, fmt.Errorf("unsupported OS: %s", osName)
+		return nil, fmt.Errorf("%w: unsupported OS: %s", ErrImageUnavailable, osName)
 	}
 
 	return &img, nil
 }
 
-func (q *Qemu) downloadOSImage(image *Image) (string, error) {
+// * default for WithHTTPClient, no overall timeout as images are large; cancel through ctx instead
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// * one download per image in this process, concurrent creates wait for it
+func (q *Qemu) downloadOSImage(ctx context.Context, image *Image) (string, error) {
 	imagePath := filepath.Join(q.Folder.Image, image.Filename)
-	if _, err := os.Stat(imagePath); err == nil {
-		// * image exists
-		return imagePath, nil
+	for {
+		if _, err := os.Stat(imagePath); err == nil {
+			// * image exists
+			return imagePath, nil
+		}
+
+		q.downloadMu.Lock()
+		done, busy := q.downloads[imagePath]
+		if !busy {
+			if q.downloads == nil {
+				q.downloads = make(map[string]chan struct{})
+			}
+			done = make(chan struct{})
+			q.downloads[imagePath] = done
+		}
+		q.downloadMu.Unlock()
+
+		if !busy {
+			defer func() {
+				q.downloadMu.Lock()
+				delete(q.downloads, imagePath)
+				q.downloadMu.Unlock()
+				close(done)
+			}()
+			break
+		}
+
+		q.infof(0, "waiting for download: %s (%s)", image.OS, image.Version)
+		// * the file is there afterwards, or that download failed and this one tries again
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-done:
+		}
+	}
+
+	q.infof(0, "download: %s (%s)", image.OS, image.Version)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, image.URL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 
-	fmt.Printf("[*] download: %s (%s)\n", image.OS, image.Version)
-	resp, err := http.Get(image.URL)
+	resp, err := q.client().Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to download: %w", err)
+		return "", fmt.Errorf("%w: failed to download: %w", ErrImageUnavailable, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		// * HTTP error
-		return "", fmt.Errorf("HTTP %d", resp.StatusCode)
+		return "", fmt.Errorf("%w: HTTP %d", ErrImageUnavailable, resp.StatusCode)
 	}
 
 	size := resp.ContentLength
-	tmpFile := imagePath + ".tmp"
-	imageFile, err := os.Create(tmpFile)
+	// * unique per download, another process fetching the same image does not write into it
+	imageFile, err := os.CreateTemp(q.Folder.Image, image.Filename+".*.tmp")
 	if err != nil {
 		return "", fmt.Errorf("failed to create: %w", err)
 	}
 	defer imageFile.Close()
+	tmpFile := imageFile.Name()
 
-	Progress := &Progress{
+	progress := &Progress{
 		Total:     size,
 		Completed: 0,
+		ctx:       ctx,
+		qemu:      q,
+		phase:     "download",
 	}
 
-	reader := io.TeeReader(resp.Body, Progress)
+	reader := io.TeeReader(resp.Body, progress)
 
 	if size > 0 {
-		fmt.Printf("[*] total size: %.2f MB\n", float64(size)/1024/1024)
+		q.infof(0, "total size: %.2f MB", float64(size)/1024/1024)
 	}
 
 	_, err = io.Copy(imageFile, reader)
+	if closeErr := imageFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		os.Remove(tmpFile)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 		return "", fmt.Errorf("failed to write file: %w", err)
 	}
 
+	// * CreateTemp makes it 0600
+	if err := os.Chmod(tmpFile, 0644); err != nil {
+		os.Remove(tmpFile)
+		return "", fmt.Errorf("failed to chmod file: %w", err)
+	}
+
 	if err := os.Rename(tmpFile, imagePath); err != nil {
 		os.Remove(tmpFile)
 		return "", fmt.Errorf("failed to rename file: %w", err)
 	}
 
-	fmt.Printf("\n[*] filePath: %s\n", imagePath)
+	q.infof(0, "filePath: %s", imagePath)
 	return imagePath, nil
 }
 
-func (q *Qemu) generateVMDisk(vmid int, imagePath, size string) (string, error) {
+func (q *Qemu) generateVMDisk(ctx context.Context, vmid int, imagePath, size string) (string, error) {
 	ext := filepath.Ext(imagePath)
 	if ext == "" {
 		return "", fmt.Errorf("invalid image file")
 	}
 
-	fmt.Printf("[*] copying image to VM directory\n")
+	q.infof(vmid, "copying image to VM directory")
 	target := fmt.Sprintf("%d-0%s", vmid, ext)
 	targetPath := filepath.Join(q.Folder.VM, target)
-	if err := copy(imagePath, targetPath); err != nil {
+	if err := q.copy(ctx, vmid, imagePath, targetPath); err != nil {
+		os.Remove(targetPath)
 		return "", fmt.Errorf("failed to copy: %w", err)
 	}
 
 	if size == "" {
+		os.Remove(targetPath)
 		return "", fmt.Errorf("disk size is required")
 	}
 
-	fmt.Printf("\n[*] resizing disk to %s\n", size)
-	cmd := exec.Command("qemu-img", "resize", targetPath, size)
+	if task := taskFrom(ctx); task != nil {
+		task.Logf("resizing disk to %s", size)
+	}
+	q.infof(vmid, "resizing disk to %s", size)
+	cmd := exec.CommandContext(ctx, "qemu-img", "resize", targetPath, size)
 	if err := cmd.Run(); err != nil {
+		os.Remove(targetPath)
 		return "", fmt.Errorf("failed to resize: %w", err)
 	}
 
 	return targetPath, nil
 }
 
-func copy(imagePath, targetPath string) error {
+func (q *Qemu) copy(ctx context.Context, vmid int, imagePath, targetPath string) error {
 	fromPath, err := os.Open(imagePath)
 	if err != nil {
 		return fmt.Errorf("failed to open image: %w", err)
@@ -202,10 +269,14 @@ func copy(imagePath, targetPath string) error {
 	progress := &Progress{
 		Total:     size,
 		Completed: 0,
+		ctx:       ctx,
+		qemu:      q,
+		vmid:      vmid,
+		phase:     "copy",
 	}
 
 	if size > 0 {
-		fmt.Printf("[*] total size: %.2f MB\n", float64(size)/1024/1024)
+		q.infof(vmid, "total size: %.2f MB", float64(size)/1024/1024)
 	}
 
 	reader := io.TeeReader(fromPath, progress)
@@ -220,19 +291,27 @@ func copy(imagePath, targetPath string) error {
 
 // * for io.TeeReader to track download progress
 func (d *Progress) Write(progress []byte) (int, error) {
+	// * abort io.Copy once cancelled
+	if d.ctx != nil {
+		if err := d.ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+
 	bytes := len(progress)
 	d.Completed += int64(bytes)
 
-	if d.Total > 0 {
-		percent := float64(d.Completed) / float64(d.Total) * 100
-		completed := float64(d.Completed) / 1024 / 1024
-		total := float64(d.Total) / 1024 / 1024
-
-		fmt.Printf("\r[*] progress: %.2f MB / %.2f MB (%.2f%%)", completed, total, percent)
-	} else {
-		completed := float64(d.Completed) / 1024 / 1024
-		fmt.Printf("\r[*] progress: %.2f MB", completed)
+	if task := taskFrom(d.ctx); task != nil {
+		task.setProgress(d.Completed, d.Total)
 	}
 
+	d.qemu.emit(Event{
+		Type:      EventProgress,
+		VMID:      d.vmid,
+		Phase:     d.phase,
+		Completed: d.Completed,
+		Total:     d.Total,
+	})
+
 	return bytes, nil
 }
@@ -0,0 +1,54 @@
+package goQemu
+
+import (
+	"errors"
+	"fmt"
+)
+
+// * match with errors.Is, messages read as "VM 101 is not running"
+var (
+	ErrNotFound         = errors.New("does not exist")
+	ErrAlreadyRunning   = errors.New("already running")
+	ErrNotRunning       = errors.New("not running")
+	ErrInvalidState     = errors.New("invalid state for this operation")
+	ErrVMIDInUse        = errors.New("already in use")
+	ErrNoVMIDAvailable  = errors.New("no available VMID can be assigned")
+	ErrInvalidConfig    = errors.New("invalid config")
+	ErrImageUnavailable = errors.New("image unavailable")
+	ErrLocked           = errors.New("locked")
+)
+
+// * errors.Is(err, ErrInvalidConfig) matches, errors.As gives the field
+type ConfigError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrInvalidConfig, e.Reason)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return ErrInvalidConfig
+}
+
+func configError(field, format string, args ...any) error {
+	return &ConfigError{
+		Field:  field,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+// * errors.Is(err, ErrLocked) matches
+type LockError struct {
+	VMID int
+	LockInfo
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("VM %d is %s (%s, PID %d)", e.VMID, ErrLocked, e.Operation, e.PID)
+}
+
+func (e *LockError) Unwrap() error {
+	return ErrLocked
+}
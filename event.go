@@ -0,0 +1,136 @@
+package goQemu
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	EventProgress  = "progress"
+	EventLifecycle = "lifecycle"
+	EventInfo      = "info"
+	EventWarning   = "warning"
+)
+
+type Event struct {
+	Type      string    `json:"type"`
+	VMID      int       `json:"vmid,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	From      string    `json:"from,omitempty"`      // lifecycle
+	To        string    `json:"to,omitempty"`        // lifecycle
+	Phase     string    `json:"phase,omitempty"`     // progress
+	Completed int64     `json:"completed,omitempty"` // progress, bytes
+	Total     int64     `json:"total,omitempty"`     // progress, 0 when unknown
+	At        time.Time `json:"at"`
+}
+
+// * Notify is called synchronously from the operation, keep it fast
+type Observer interface {
+	Notify(event Event)
+}
+
+type ObserverFunc func(event Event)
+
+func (f ObserverFunc) Notify(event Event) {
+	f(event)
+}
+
+// * events are dropped when ch is full, an operation never blocks on a slow reader
+func ChannelObserver(ch chan<- Event) Observer {
+	return ObserverFunc(func(event Event) {
+		select {
+		case ch <- event:
+		default:
+		}
+	})
+}
+
+func MultiObserver(observers ...Observer) Observer {
+	return ObserverFunc(func(event Event) {
+		for _, observer := range observers {
+			if observer != nil {
+				observer.Notify(event)
+			}
+		}
+	})
+}
+
+// * the "[*] ..." console output
+type ConsoleObserver struct {
+	mu       sync.Mutex
+	w        io.Writer
+	progress bool
+}
+
+func NewConsoleObserver(w io.Writer) *ConsoleObserver {
+	return &ConsoleObserver{w: w}
+}
+
+func (c *ConsoleObserver) Notify(event Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if event.Type == EventProgress {
+		completed := float64(event.Completed) / 1024 / 1024
+		if event.Total > 0 {
+			total := float64(event.Total) / 1024 / 1024
+			percent := float64(event.Completed) / float64(event.Total) * 100
+			fmt.Fprintf(c.w, "\r[*] %s: %.2f MB / %.2f MB (%.2f%%)", event.Phase, completed, total, percent)
+		} else {
+			fmt.Fprintf(c.w, "\r[*] %s: %.2f MB", event.Phase, completed)
+		}
+		c.progress = true
+		return
+	}
+
+	// * finish the progress line first
+	if c.progress {
+		fmt.Fprintln(c.w)
+		c.progress = false
+	}
+
+	switch event.Type {
+	case EventInfo:
+		fmt.Fprintf(c.w, "[*] %s\n", event.Message)
+	case EventWarning:
+		if event.Error != "" {
+			fmt.Fprintf(c.w, "[!] %s: %s\n", event.Message, event.Error)
+		} else {
+			fmt.Fprintf(c.w, "[!] %s\n", event.Message)
+		}
+	}
+}
+
+// * nil observer discards everything
+func (q *Qemu) emit(event Event) {
+	if q == nil || q.Observer == nil {
+		return
+	}
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	q.Observer.Notify(event)
+}
+
+func (q *Qemu) infof(vmid int, format string, args ...any) {
+	q.emit(Event{
+		Type:    EventInfo,
+		VMID:    vmid,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (q *Qemu) warn(vmid int, message string, err error) {
+	event := Event{
+		Type:    EventWarning,
+		VMID:    vmid,
+		Message: message,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	q.emit(event)
+}
@@ -0,0 +1,320 @@
+package goQemu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// * a single-directory ISO9660 image with Joliet and Rock Ridge, enough for a
+// * NoCloud seed; layout: descriptors at 16-18, path tables at 19-22, primary and
+// * Joliet root at 23-24, Rock Ridge continuation at 25, file data from 26
+const (
+	isoSectorSize = 2048
+
+	isoPVDSector       = 16
+	isoSVDSector       = 17
+	isoTerminator      = 18
+	isoPathTableSector = 19 // * L and M primary, then L and M Joliet
+	isoRootSector      = 23
+	isoJolietSector    = 24
+	isoCESector        = 25
+	isoDataSector      = 26
+
+	isoPathTableSize = 10
+
+	rripID     = "RRIP_1991A"
+	rripDesc   = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	rripSource = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+)
+
+type isoFile struct {
+	name   string // * Rock Ridge and Joliet name
+	short  string // * ISO9660 level 1 name, e.g. META_DAT.;1
+	data   []byte
+	extent uint32
+	joliet []byte
+}
+
+func writeISO(w io.Writer, volumeID string, files map[string]string, modTime time.Time) error {
+	if len(volumeID) > 16 {
+		return fmt.Errorf("volume ID too long: %s", volumeID)
+	}
+
+	entries := make([]*isoFile, 0, len(files))
+	for name, data := range files {
+		if name == "" || len(name) > 64 || strings.ContainsAny(name, "/\\:;*?\x00") {
+			return fmt.Errorf("invalid ISO file name: %q", name)
+		}
+		entries = append(entries, &isoFile{name: name, data: []byte(data)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	assignShortNames(entries)
+
+	sector := uint32(isoDataSector)
+	for _, entry := range entries {
+		if len(entry.data) == 0 {
+			continue
+		}
+		entry.extent = sector
+		sector += uint32((len(entry.data) + isoSectorSize - 1) / isoSectorSize)
+	}
+	totalSectors := sector
+
+	image := make([]byte, int(totalSectors)*isoSectorSize)
+	at := func(n uint32) []byte {
+		return image[int(n)*isoSectorSize : int(n+1)*isoSectorSize]
+	}
+
+	er := susp("ER", 1, []byte{byte(len(rripID)), byte(len(rripDesc)), byte(len(rripSource)), 1}, []byte(rripID+rripDesc+rripSource))
+	copy(at(isoCESector), er)
+
+	// * primary tree, Rock Ridge in the system use area
+	rootUse := concat(
+		susp("SP", 1, []byte{0xBE, 0xEF, 0}),
+		rripPX(0o40555, 2),
+		rripTF(modTime),
+		susp("CE", 1, both32(isoCESector), both32(0), both32(uint32(len(er)))),
+	)
+	primary := [][]byte{
+		dirRecord([]byte{0}, isoRootSector, isoSectorSize, 2, modTime, rootUse),
+		dirRecord([]byte{1}, isoRootSector, isoSectorSize, 2, modTime, concat(rripPX(0o40555, 2), rripTF(modTime))),
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].short < entries[j].short
+	})
+	for _, entry := range entries {
+		nm := susp("NM", 1, []byte{0}, []byte(entry.name))
+		primary = append(primary, dirRecord([]byte(entry.short), entry.extent, uint32(len(entry.data)), 0, modTime,
+			concat(rripPX(0o100444, 1), rripTF(modTime), nm)))
+	}
+
+	// * Joliet tree, UCS-2 names, no system use
+	joliet := [][]byte{
+		dirRecord([]byte{0}, isoJolietSector, isoSectorSize, 2, modTime, nil),
+		dirRecord([]byte{1}, isoJolietSector, isoSectorSize, 2, modTime, nil),
+	}
+	for _, entry := range entries {
+		entry.joliet = ucs2(entry.name + ";1")
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].joliet, entries[j].joliet) < 0
+	})
+	for _, entry := range entries {
+		joliet = append(joliet, dirRecord(entry.joliet, entry.extent, uint32(len(entry.data)), 0, modTime, nil))
+	}
+
+	for i, records := range [][][]byte{primary, joliet} {
+		dir := at(isoRootSector + uint32(i))
+		offset := 0
+		for _, record := range records {
+			if offset+len(record) > isoSectorSize {
+				return fmt.Errorf("too many files for a single-sector ISO directory")
+			}
+			offset += copy(dir[offset:], record)
+		}
+	}
+
+	writePathTables(at(isoPathTableSector), at(isoPathTableSector+1), isoRootSector)
+	writePathTables(at(isoPathTableSector+2), at(isoPathTableSector+3), isoJolietSector)
+
+	writeVolumeDescriptor(at(isoPVDSector), 1, volumeID, totalSectors, isoPathTableSector, isoRootSector, modTime)
+	writeVolumeDescriptor(at(isoSVDSector), 2, volumeID, totalSectors, isoPathTableSector+2, isoJolietSector, modTime)
+
+	terminator := at(isoTerminator)
+	terminator[0] = 255
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+
+	for _, entry := range entries {
+		if entry.extent > 0 {
+			copy(image[int(entry.extent)*isoSectorSize:], entry.data)
+		}
+	}
+
+	_, err := w.Write(image)
+	return err
+}
+
+// * 8.3 d-characters, unique within the directory
+func assignShortNames(entries []*isoFile) {
+	used := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		base, ext, _ := strings.Cut(strings.ToUpper(entry.name), ".")
+		base, ext = dChars(base, 8), dChars(ext, 3)
+
+		short := base
+		for n := 1; used[short+"."+ext]; n++ {
+			suffix := fmt.Sprint(n)
+			short = base[:min(len(base), 8-len(suffix))] + suffix
+		}
+		used[short+"."+ext] = true
+		entry.short = short + "." + ext + ";1"
+	}
+}
+
+func dChars(value string, limit int) string {
+	var b strings.Builder
+	for _, r := range value {
+		if b.Len() == limit {
+			break
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+func dirRecord(identifier []byte, extent, size uint32, flags byte, modTime time.Time, systemUse []byte) []byte {
+	length := 33 + len(identifier)
+	if len(identifier)%2 == 0 {
+		length++
+	}
+	useOffset := length
+	length += len(systemUse)
+	if length%2 == 1 {
+		length++
+	}
+
+	record := make([]byte, length)
+	record[0] = byte(length)
+	copy(record[2:], both32(extent))
+	copy(record[10:], both32(size))
+	copy(record[18:], isoDate(modTime))
+	record[25] = flags
+	copy(record[28:], both16(1))
+	record[32] = byte(len(identifier))
+	copy(record[33:], identifier)
+	copy(record[useOffset:], systemUse)
+	return record
+}
+
+// * a single root directory, number 1 and its own parent
+func writePathTables(little, big []byte, rootSector uint32) {
+	little[0], big[0] = 1, 1
+	binary.LittleEndian.PutUint32(little[2:], rootSector)
+	binary.BigEndian.PutUint32(big[2:], rootSector)
+	binary.LittleEndian.PutUint16(little[6:], 1)
+	binary.BigEndian.PutUint16(big[6:], 1)
+}
+
+func writeVolumeDescriptor(sector []byte, kind byte, volumeID string, totalSectors, pathTable, rootSector uint32, modTime time.Time) {
+	text := func(field []byte, value string) {
+		for i := range field {
+			field[i] = ' '
+		}
+		if kind == 2 {
+			// * UCS-2 padded with U+0020
+			for i := 0; i+1 < len(field); i += 2 {
+				field[i], field[i+1] = 0, ' '
+			}
+			copy(field, ucs2(value))
+			return
+		}
+		copy(field, value)
+	}
+
+	sector[0] = kind
+	copy(sector[1:], "CD001")
+	sector[6] = 1
+	text(sector[8:40], "")
+	// * kept as given like genisoimage does, cloud-init looks for "cidata"
+	text(sector[40:72], volumeID)
+	copy(sector[80:], both32(totalSectors))
+	if kind == 2 {
+		copy(sector[88:], "%/E") // * Joliet UCS-2 level 3
+	}
+	copy(sector[120:], both16(1))
+	copy(sector[124:], both16(1))
+	copy(sector[128:], both16(isoSectorSize))
+	copy(sector[132:], both32(isoPathTableSize))
+	binary.LittleEndian.PutUint32(sector[140:], pathTable)
+	binary.BigEndian.PutUint32(sector[148:], pathTable+1)
+	copy(sector[156:], dirRecord([]byte{0}, rootSector, isoSectorSize, 2, modTime, nil))
+	text(sector[190:318], "")
+	text(sector[318:446], "")
+	text(sector[446:574], "")
+	text(sector[574:702], "GO-QEMU")
+	text(sector[702:739], "")
+	text(sector[739:776], "")
+	text(sector[776:813], "")
+	copy(sector[813:], decDate(modTime))
+	copy(sector[830:], decDate(modTime))
+	copy(sector[847:], decDate(time.Time{}))
+	copy(sector[864:], decDate(time.Time{}))
+	sector[881] = 1
+}
+
+func susp(signature string, version byte, fields ...[]byte) []byte {
+	body := concat(fields...)
+	entry := make([]byte, 4, 4+len(body))
+	copy(entry, signature)
+	entry[2] = byte(4 + len(body))
+	entry[3] = version
+	return append(entry, body...)
+}
+
+func rripPX(mode, links uint32) []byte {
+	return susp("PX", 1, both32(mode), both32(links), both32(0), both32(0))
+}
+
+// * modify and access time
+func rripTF(modTime time.Time) []byte {
+	return susp("TF", 1, []byte{0x06}, isoDate(modTime), isoDate(modTime))
+}
+
+func isoDate(t time.Time) []byte {
+	t = t.UTC()
+	return []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
+
+// * 17-byte form of the volume descriptor, all zeros when unset
+func decDate(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte(strings.Repeat("0", 16)), 0)
+	}
+	t = t.UTC()
+	value := fmt.Sprintf("%04d%02d%02d%02d%02d%02d%02d", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/1e7)
+	return append([]byte(value), 0)
+}
+
+func ucs2(value string) []byte {
+	units := utf16.Encode([]rune(value))
+	data := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.BigEndian.PutUint16(data[2*i:], unit)
+	}
+	return data
+}
+
+func both16(v uint16) []byte {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint16(data, v)
+	binary.BigEndian.PutUint16(data[2:], v)
+	return data
+}
+
+func both32(v uint32) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint32(data, v)
+	binary.BigEndian.PutUint32(data[4:], v)
+	return data
+}
+
+func concat(parts ...[]byte) []byte {
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	return data
+}
@@ -0,0 +1,162 @@
+package goQemu
+
+import (
+	"context"
+	"fmt"
+)
+
+func (q *Qemu) Pause(vmid int) error {
+	return q.PauseContext(context.Background(), vmid)
+}
+
+func (q *Qemu) PauseContext(ctx context.Context, vmid int) error {
+	ctx, unlock, err := q.lock(ctx, vmid, "pause")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	status, err := q.checkStatus(ctx, vmid)
+	if err != nil {
+		return err
+	}
+
+	if status == StatusPaused {
+		return fmt.Errorf("VM %d is already paused: %w", vmid, ErrInvalidState)
+	}
+
+	if _, err := q.qmpExecute(ctx, vmid, "stop", nil); err != nil {
+		return fmt.Errorf("failed to pause VM %d: %w", vmid, err)
+	}
+	q.setState(vmid, StatusPaused, "paused by user", nil)
+
+	q.infof(vmid, "VM %d paused", vmid)
+	return nil
+}
+
+func (q *Qemu) Resume(vmid int) error {
+	return q.ResumeContext(context.Background(), vmid)
+}
+
+func (q *Qemu) ResumeContext(ctx context.Context, vmid int) error {
+	ctx, unlock, err := q.lock(ctx, vmid, "resume")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	status, err := q.checkStatus(ctx, vmid)
+	if err != nil {
+		return err
+	}
+
+	if status != StatusPaused {
+		return fmt.Errorf("VM %d is not paused: %w", vmid, ErrInvalidState)
+	}
+
+	if _, err := q.qmpExecute(ctx, vmid, "cont", nil); err != nil {
+		return fmt.Errorf("failed to resume VM %d: %w", vmid, err)
+	}
+	q.setState(vmid, StatusRunning, "resumed by user", nil)
+
+	q.infof(vmid, "VM %d resumed", vmid)
+	return nil
+}
+
+// * hard reset, same as pressing the reset button
+func (q *Qemu) Reset(vmid int) error {
+	return q.ResetContext(context.Background(), vmid)
+}
+
+func (q *Qemu) ResetContext(ctx context.Context, vmid int) error {
+	ctx, unlock, err := q.lock(ctx, vmid, "reset")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := q.checkStatus(ctx, vmid); err != nil {
+		return err
+	}
+
+	if _, err := q.qmpExecute(ctx, vmid, "system_reset", nil); err != nil {
+		return fmt.Errorf("failed to reset VM %d: %w", vmid, err)
+	}
+
+	q.infof(vmid, "VM %d reset", vmid)
+	return nil
+}
+
+// * soft reboot, ask guest agent first then fall back to ctrl-alt-delete
+func (q *Qemu) Reboot(vmid int) error {
+	return q.RebootContext(context.Background(), vmid)
+}
+
+func (q *Qemu) RebootContext(ctx context.Context, vmid int) error {
+	ctx, unlock, err := q.lock(ctx, vmid, "reboot")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	status, err := q.checkStatus(ctx, vmid)
+	if err != nil {
+		return err
+	}
+
+	if status == StatusPaused {
+		return fmt.Errorf("VM %d is paused: %w", vmid, ErrInvalidState)
+	}
+
+	_, err = q.guestExecute(ctx, vmid, "guest-shutdown", map[string]any{"mode": "reboot"}, false)
+	if err == nil {
+		q.infof(vmid, "VM %d rebooting via guest agent", vmid)
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	q.warn(vmid, "guest agent unavailable, fallback to ctrl-alt-delete", err)
+
+	keys := []map[string]any{
+		{"type": "qcode", "data": "ctrl"},
+		{"type": "qcode", "data": "alt"},
+		{"type": "qcode", "data": "delete"},
+	}
+	if _, err := q.qmpExecute(ctx, vmid, "send-key", map[string]any{"keys": keys}); err != nil {
+		return fmt.Errorf("failed to reboot VM %d: %w", vmid, err)
+	}
+
+	q.infof(vmid, "VM %d rebooting via ctrl-alt-delete", vmid)
+	return nil
+}
+
+func (q *Qemu) Status(vmid int) (string, error) {
+	return q.StatusContext(context.Background(), vmid)
+}
+
+func (q *Qemu) StatusContext(ctx context.Context, vmid int) (string, error) {
+	if _, err := q.readConfig(vmid); err != nil {
+		return "", fmt.Errorf("failed to get VM %d config: %w", vmid, err)
+	}
+
+	var pid int
+	if _, pidData, err := q.getFile(q.Folder.PID, vmid); err == nil {
+		fmt.Sscanf(pidData, "%d", &pid)
+	}
+
+	return q.getState(ctx, vmid, pid).Status, nil
+}
+
+func (q *Qemu) checkStatus(ctx context.Context, vmid int) (string, error) {
+	status, err := q.StatusContext(ctx, vmid)
+	if err != nil {
+		return "", err
+	}
+
+	if status != StatusRunning && status != StatusPaused {
+		return "", fmt.Errorf("VM %d is %w", vmid, ErrNotRunning)
+	}
+
+	return status, nil
+}
@@ -1,49 +1,65 @@
 package goQemu
 
 import (
+	"context"
 	"fmt"
-	"os"
 )
 
 func (q *Qemu) List() []*Instance {
+	return q.ListContext(context.Background())
+}
+
+func (q *Qemu) ListContext(ctx context.Context) []*Instance {
 	vms := make([]*Instance, 0)
-	ids, err := os.ReadDir(q.Folder.Config)
+	ids, err := q.configIDs()
 	if err != nil {
 		return vms
 	}
 
-	for _, id := range ids {
-		if id.IsDir() {
-			continue
+	for _, vmid := range ids {
+		if ctx.Err() != nil {
+			break
 		}
 
-		var vmid int
-		if _, err := fmt.Sscanf(id.Name(), "%d.json", &vmid); err != nil {
-			continue
-		}
-
-		config, err := q.loadConfig(vmid)
+		instance, err := q.GetContext(ctx, vmid)
 		if err != nil {
 			continue
 		}
 
-		instance := &Instance{
-			Config: *config,
-			Status: "stopped",
-		}
+		vms = append(vms, instance)
+	}
 
-		if _, pidData, err := q.getFile(q.Folder.PID, vmid); err == nil {
-			var pid int
-			fmt.Sscanf(pidData, "%d", &pid)
-			instance.PID = pid
+	return vms
+}
 
-			if q.isRunning(pid) {
-				instance.Status = "running"
-			}
-		}
+func (q *Qemu) Get(vmid int) (*Instance, error) {
+	return q.GetContext(context.Background(), vmid)
+}
 
-		vms = append(vms, instance)
+// * the saved config was verified when it was written, reading it has no side effects
+func (q *Qemu) GetContext(ctx context.Context, vmid int) (*Instance, error) {
+	config, err := q.readConfig(vmid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VM %d config: %w", vmid, err)
 	}
 
-	return vms
+	var pid int
+	if _, pidData, err := q.getFile(q.Folder.PID, vmid); err == nil {
+		fmt.Sscanf(pidData, "%d", &pid)
+	}
+
+	state := q.getState(ctx, vmid, pid)
+	return &Instance{
+		Config:     *config,
+		PID:        state.PID,
+		Status:     state.Status,
+		CreatedAt:  state.CreatedAt,
+		StartedAt:  state.StartedAt,
+		StoppedAt:  state.StoppedAt,
+		ExitCode:   state.ExitCode,
+		ExitReason: state.ExitReason,
+		LogTail:    state.LogTail,
+		Lock:       q.LockHolder(vmid),
+		Pending:    state.Pending,
+	}, nil
 }
@@ -0,0 +1,208 @@
+package goQemu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+type LockInfo struct {
+	Operation string    `json:"operation"`
+	PID       int       `json:"pid"`
+	Since     time.Time `json:"since"`
+}
+
+type lockKey struct {
+	vmid int
+}
+
+// * LockHolder probes with a shared flock for a moment, lock retries before reporting ErrLocked
+const (
+	lockRetries    = 5
+	lockRetryDelay = 10 * time.Millisecond
+)
+
+// * hold the VM for an operation of the caller, e.g. "backup" or "clone";
+// * operations of this package on the VM fail with ErrLocked until release
+func (q *Qemu) Lock(vmid int, operation string) (release func(), err error) {
+	_, release, err = q.lock(context.Background(), vmid, operation)
+	return release, err
+}
+
+// * nil when the VM is not locked
+func (q *Qemu) LockHolder(vmid int) *LockInfo {
+	q.lockMu.Lock()
+	info, ok := q.locks[vmid]
+	q.lockMu.Unlock()
+	if ok {
+		holder := *info
+		return &holder
+	}
+
+	if q.Folder.Lock == "" {
+		return nil
+	}
+
+	file, err := os.Open(q.lockPath(vmid))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	// * release empties the file, only a holder or a crashed one leaves it filled;
+	// * skipping the probe keeps it out of the way of lock in other processes
+	holder := &LockInfo{}
+	if data, err := io.ReadAll(file); err != nil || json.Unmarshal(data, holder) != nil {
+		return nil
+	}
+
+	// * a dead holder releases the flock, whatever is left in the file is stale
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		return nil
+	}
+
+	return holder
+}
+
+func (q *Qemu) lockPath(vmid int) string {
+	return filepath.Join(q.Folder.Lock, fmt.Sprintf("%d.lock", vmid))
+}
+
+// * in-process map first, then an flock on locks/<vmid>.lock for other processes;
+// * the returned ctx marks the lock as held so nested operations pass through
+func (q *Qemu) lock(ctx context.Context, vmid int, operation string) (context.Context, func(), error) {
+	if held, _ := ctx.Value(lockKey{vmid}).(bool); held {
+		return ctx, func() {}, nil
+	}
+
+	info := &LockInfo{
+		Operation: operation,
+		PID:       os.Getpid(),
+		Since:     time.Now(),
+	}
+
+	q.lockMu.Lock()
+	if holder, ok := q.locks[vmid]; ok {
+		q.lockMu.Unlock()
+		return ctx, nil, &LockError{VMID: vmid, LockInfo: *holder}
+	}
+	if q.locks == nil {
+		q.locks = make(map[int]*LockInfo)
+	}
+	q.locks[vmid] = info
+	q.lockMu.Unlock()
+
+	unlockProcess := func() {
+		q.lockMu.Lock()
+		delete(q.locks, vmid)
+		q.lockMu.Unlock()
+	}
+
+	unlockFile, err := q.lockFile(vmid, info)
+	if err != nil {
+		unlockProcess()
+		return ctx, nil, err
+	}
+
+	release := func() {
+		unlockFile()
+		unlockProcess()
+	}
+
+	return context.WithValue(ctx, lockKey{vmid}, true), release, nil
+}
+
+func (q *Qemu) lockFile(vmid int, info *LockInfo) (func(), error) {
+	if q.Folder.Lock == "" {
+		return func() {}, nil
+	}
+
+	// * never removed, unlinking a lock file races with a process opening it
+	file, err := os.OpenFile(q.lockPath(vmid), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	var holder LockInfo
+	for attempt := 1; ; attempt++ {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			break
+		}
+
+		// * a live holder has written itself in, otherwise it is most likely a probe
+		holder = LockInfo{}
+		if data, err := os.ReadFile(q.lockPath(vmid)); err == nil {
+			json.Unmarshal(data, &holder)
+		}
+		if (holder.PID != 0 && processAlive(holder.PID)) || attempt == lockRetries {
+			break
+		}
+		time.Sleep(lockRetryDelay)
+	}
+	if err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, &LockError{VMID: vmid, LockInfo: holder}
+		}
+		return nil, fmt.Errorf("failed to lock VM %d: %w", vmid, err)
+	}
+
+	data, _ := json.Marshal(info)
+	file.Truncate(0)
+	file.WriteAt(data, 0)
+
+	return func() {
+		file.Truncate(0)
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// * pick a free VMID and lock it in one step, held across processes by locks/vmid.lock
+func (q *Qemu) reserveVMID(ctx context.Context, operation string) (int, context.Context, func(), error) {
+	if q.Folder.Lock != "" {
+		file, err := os.OpenFile(filepath.Join(q.Folder.Lock, "vmid.lock"), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return 0, ctx, nil, fmt.Errorf("failed to open lock file: %w", err)
+		}
+		defer file.Close()
+
+		// * short critical section, blocking is fine
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+			return 0, ctx, nil, fmt.Errorf("failed to lock VMID allocation: %w", err)
+		}
+		defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	}
+
+	used, err := q.usedVMIDs()
+	if err != nil {
+		return 0, ctx, nil, err
+	}
+
+	// * a VM being created has no config yet but holds its lock
+	start, end := q.vmidRange()
+	for id := start; id <= end; id++ {
+		if used[id] {
+			continue
+		}
+
+		lockCtx, release, err := q.lock(ctx, id, operation)
+		if errors.Is(err, ErrLocked) {
+			continue
+		}
+		if err != nil {
+			return 0, ctx, nil, err
+		}
+		return id, lockCtx, release, nil
+	}
+
+	return 0, ctx, nil, ErrNoVMIDAvailable
+}
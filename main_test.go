@@ -2,14 +2,34 @@
 package goQemu
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
 )
 
 // func TestNewCloudInit(t *testing.T) {
@@ -60,17 +80,11 @@ import (
 // }
 
 func TestGetOSImageInfo(t *testing.T) {
-	// Setup environment variables
-	os.Setenv("GO_QEMU_DEBIAN_VERSION", "11,12,13")
-	os.Setenv("GO_QEMU_UBUNTU_VERSION", "20.04,22.04")
-	os.Setenv("GO_QEMU_ROCKYLINUX_VERSION", "8,9")
-	defer func() {
-		os.Unsetenv("GO_QEMU_DEBIAN_VERSION")
-		os.Unsetenv("GO_QEMU_UBUNTU_VERSION")
-		os.Unsetenv("GO_QEMU_ROCKYLINUX_VERSION")
-	}()
-
-	m := &Qemu{}
+	m := &Qemu{catalog: map[string][]string{
+		"debian":     {"11", "12", "13"},
+		"ubuntu":     {"20.04", "22.04"},
+		"rockylinux": {"8", "9"},
+	}}
 
 	tests := []struct {
 		name      string
@@ -186,7 +200,7 @@ func TestDownloadOSImage(t *testing.T) {
 				}
 			}
 
-			result, err := m.downloadOSImage(tt.img)
+			result, err := m.downloadOSImage(context.Background(), tt.img)
 
 			if tt.expectErr {
 				if err == nil {
@@ -236,7 +250,7 @@ func TestGenerateVMDisk(t *testing.T) {
 	vmid := 1
 	imagePath := srcFile.Name()
 	size := "20M"
-	targetPath, err := folder.generateVMDisk(vmid, imagePath, size)
+	targetPath, err := folder.generateVMDisk(context.Background(), vmid, imagePath, size)
 	if err != nil {
 		t.Fatalf("generateVMDisk failed: %v", err)
 	}
@@ -255,11 +269,9 @@ func TestGenerateVMDisk(t *testing.T) {
 func TestNewQemu(t *testing.T) {
 	// Set up a temporary directory for testing
 	tempDir := t.TempDir()
-	os.Setenv("GO_QEMU_PATH", tempDir)
-	defer os.Unsetenv("GO_QEMU_PATH")
 
 	// Call NewVMManager
-	folder, err := NewQemu()
+	folder, err := NewQemu(WithPath(tempDir), WithObserver(nil))
 	if err != nil {
 		t.Fatalf("NewVMManager failed: %v", err)
 	}
@@ -416,16 +428,6 @@ func TestAssignVMID(t *testing.T) {
 // }
 
 func TestGetOSImageInfo_AdditionalCases(t *testing.T) {
-	// Setup environment variables
-	os.Setenv("GO_QEMU_DEBIAN_VERSION", "11,12,13")
-	os.Setenv("GO_QEMU_UBUNTU_VERSION", "20.04,22.04,24.04")
-	os.Setenv("GO_QEMU_ROCKYLINUX_VERSION", "8,9,10")
-	defer func() {
-		os.Unsetenv("GO_QEMU_DEBIAN_VERSION")
-		os.Unsetenv("GO_QEMU_UBUNTU_VERSION")
-		os.Unsetenv("GO_QEMU_ROCKYLINUX_VERSION")
-	}()
-
 	m := &Qemu{}
 
 	tests := []struct {
@@ -676,3 +678,1896 @@ func filterVMsByStatus(vms []*Instance, status string) []*Instance {
 	}
 	return filtered
 }
+
+func TestRecordExit(t *testing.T) {
+	tempDir := t.TempDir()
+	q := &Qemu{
+		Folder: Folder{
+			State: tempDir,
+			Log:   tempDir,
+		},
+	}
+
+	os.WriteFile(filepath.Join(tempDir, "101.log"), []byte("qemu: boot\nqemu: fatal error\n"), 0644)
+
+	tests := []struct {
+		name       string
+		prepare    string
+		waitErr    error
+		expectStat string
+	}{
+		{"Guest poweroff", StatusRunning, nil, StatusStopped},
+		{"Crash", StatusRunning, &exec.ExitError{}, StatusCrashed},
+		{"Requested shutdown", StatusShuttingDown, &exec.ExitError{}, StatusStopped},
+		{"Already stopped by user", StatusStopped, &exec.ExitError{}, StatusStopped},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q.setState(101, StatusStarting, "", nil)
+			q.setState(101, tt.prepare, "", func(s *State) {
+				s.PID = 4242
+			})
+
+			q.recordExit(101, 4242, tt.waitErr)
+
+			state, err := q.loadState(101)
+			if err != nil {
+				t.Fatalf("loadState failed: %v", err)
+			}
+			if state.Status != tt.expectStat {
+				t.Errorf("Expected status %s, got %s", tt.expectStat, state.Status)
+			}
+			if state.StoppedAt == nil {
+				t.Errorf("Expected StoppedAt to be set")
+			}
+			if tt.expectStat == StatusCrashed && state.LogTail == "" {
+				t.Errorf("Expected log tail for crashed VM")
+			}
+		})
+	}
+}
+
+func TestShouldRestart(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RestartPolicy
+		state   State
+		restart bool
+	}{
+		{"Never", RestartPolicy{Policy: RestartNever}, State{Status: StatusCrashed}, false},
+		{"On failure after crash", RestartPolicy{Policy: RestartOnFailure}, State{Status: StatusCrashed}, true},
+		{"On failure after guest poweroff", RestartPolicy{Policy: RestartOnFailure}, State{Status: StatusStopped, Shutdown: "guest"}, false},
+		{"On failure retries exhausted", RestartPolicy{Policy: RestartOnFailure, MaxRetries: 3}, State{Status: StatusCrashed, Restarts: 3}, false},
+		{"Always after guest poweroff", RestartPolicy{Policy: RestartAlways}, State{Status: StatusStopped, Shutdown: "guest"}, true},
+		{"Always after user stop", RestartPolicy{Policy: RestartAlways}, State{Status: StatusStopped, Shutdown: "user"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldRestart(tt.policy, &tt.state); got != tt.restart {
+				t.Errorf("Expected restart %v, got %v", tt.restart, got)
+			}
+		})
+	}
+}
+
+func TestBootOrder(t *testing.T) {
+	tempDir := t.TempDir()
+	q := &Qemu{Folder: Folder{Config: tempDir}}
+
+	configs := []Config{
+		{ID: 100, OnBoot: true},
+		{ID: 101, OnBoot: true, StartOrder: 2},
+		{ID: 102, OnBoot: true, StartOrder: 1},
+		{ID: 103, StartOrder: 1},
+	}
+	for _, config := range configs {
+		data, _ := json.Marshal(config)
+		os.WriteFile(filepath.Join(tempDir, fmt.Sprintf("%d.json", config.ID)), data, 0644)
+	}
+
+	ordered, err := q.bootOrder()
+	if err != nil {
+		t.Fatalf("bootOrder failed: %v", err)
+	}
+
+	expected := []int{102, 103, 101, 100}
+	for i, config := range ordered {
+		if config.ID != expected[i] {
+			t.Errorf("Position %d: expected VM %d, got %d", i, expected[i], config.ID)
+		}
+	}
+}
+
+func TestSystemdUnit(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "go qemu.env")
+	os.WriteFile(envFile, []byte("GO_QEMU_DEFAULT_PASSWORD=secret\nGO_QEMU_STORE=bolt\n"), 0600)
+
+	q, err := newQemu(WithEnv(envFile), WithPath("/srv/go qemu"), WithVMIDRange(200, 299))
+	if err != nil {
+		t.Fatalf("newQemu failed: %v", err)
+	}
+
+	unit := q.SystemdUnit("/opt/go $qemu/go-qemu")
+	for _, line := range []string{
+		`ExecStart="/opt/go $$qemu/go-qemu" start-all`,
+		`ExecStop="/opt/go $$qemu/go-qemu" stop-all`,
+		"EnvironmentFile=" + envFile,
+		`Environment="GO_QEMU_PATH=/srv/go qemu"`,
+		`Environment="GO_QEMU_STORE=bolt"`,
+		`Environment="GO_QEMU_VMID_START=200"`,
+		`Environment="GO_QEMU_VMID_END=299"`,
+	} {
+		if !strings.Contains(unit, line+"\n") {
+			t.Errorf("Expected %s in unit:\n%s", line, unit)
+		}
+	}
+	if !strings.Contains(unit, "WorkingDirectory=") {
+		t.Errorf("Expected WorkingDirectory in unit:\n%s", unit)
+	}
+	if strings.Contains(unit, "secret") {
+		t.Errorf("Expected default password to stay in the env file:\n%s", unit)
+	}
+
+	tests := []struct {
+		value  string
+		expect string
+	}{
+		{"/usr/bin/go-qemu", `"/usr/bin/go-qemu"`},
+		{`a "b" c`, `"a \"b\" c"`},
+		{`C:\x`, `"C:\\x"`},
+		{"100%", `"100%%"`},
+	}
+	for _, tt := range tests {
+		if got := systemdQuote(tt.value); got != tt.expect {
+			t.Errorf("systemdQuote(%q) = %s, want %s", tt.value, got, tt.expect)
+		}
+	}
+}
+
+func TestIsVMProcess(t *testing.T) {
+	tempDir := t.TempDir()
+	q := &Qemu{
+		Binary: "/usr/libexec/qemu-kvm",
+		Folder: Folder{
+			Config:  tempDir,
+			Monitor: "/var/lib/go-qemu/monitors",
+		},
+	}
+
+	config := Config{ID: 101, Options: Options{UUID: "123e4567-e89b-12d3-a456-426614174000"}}
+	data, _ := json.Marshal(config)
+	os.WriteFile(filepath.Join(tempDir, "101.json"), data, 0644)
+
+	tests := []struct {
+		name   string
+		vmid   int
+		args   []string
+		expect bool
+	}{
+		{"Matching UUID", 101, []string{"/usr/bin/qemu-system-x86_64", "-smbios", "type=1,uuid=123e4567-e89b-12d3-a456-426614174000"}, true},
+		{"Different UUID", 101, []string{"qemu-system-x86_64", "-smbios", "type=1,uuid=00000000-0000-0000-0000-000000000000"}, false},
+		{"Unrelated process", 101, []string{"/usr/sbin/sshd", "-D"}, false},
+		{"Configured binary", 101, []string{"/usr/libexec/qemu-kvm", "-smbios", "type=1,uuid=123e4567-e89b-12d3-a456-426614174000"}, true},
+		{"Monitor fallback", 102, []string{"qemu-system-aarch64", "-monitor", "unix:/var/lib/go-qemu/monitors/102.sock,server,nowait"}, true},
+		{"Empty cmdline", 101, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := q.isVMProcess(tt.vmid, tt.args); got != tt.expect {
+				t.Errorf("Expected %v, got %v", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestParseQemuArgs(t *testing.T) {
+	q := &Qemu{Folder: Folder{Monitor: "/var/lib/go-qemu/monitors"}}
+
+	args := []string{
+		"/usr/bin/qemu-system-x86_64",
+		"-m", "2048",
+		"-monitor", "unix:/var/lib/go-qemu/monitors/105.sock,server,nowait",
+		"-smbios", "type=1,uuid=123e4567-e89b-12d3-a456-426614174000",
+	}
+
+	proc, ok := q.parseQemuArgs(4242, args)
+	if !ok {
+		t.Fatalf("Expected QEMU process to be recognised")
+	}
+	if proc.uuid != "123e4567-e89b-12d3-a456-426614174000" {
+		t.Errorf("Unexpected UUID: %s", proc.uuid)
+	}
+
+	vmid, ok := q.monitorVMID(proc.monitor)
+	if !ok || vmid != 105 {
+		t.Errorf("Expected VMID 105 from monitor %s, got %d", proc.monitor, vmid)
+	}
+
+	if _, ok := q.parseQemuArgs(1, []string{"/sbin/init"}); ok {
+		t.Errorf("Expected non-QEMU process to be ignored")
+	}
+
+	q.Binary = "/usr/libexec/qemu-kvm"
+	if proc, ok := q.parseQemuArgs(4243, append([]string{"qemu-kvm"}, args[1:]...)); !ok || proc.monitor == "" {
+		t.Errorf("Expected process of the configured binary to be recognised")
+	}
+
+	if _, ok := (&Qemu{Folder: Folder{Monitor: "/other"}}).monitorVMID(proc.monitor); ok {
+		t.Errorf("Expected monitor outside folder to be ignored")
+	}
+}
+
+// * sh stands in for QEMU, argv[0] and the UUID marker are what isVMProcess checks
+func startFakeQemu(t *testing.T, uuid string) int {
+	t.Helper()
+	return startFakeQemuScript(t, uuid, "sleep 30")
+}
+
+func startFakeQemuScript(t *testing.T, uuid, script string) int {
+	t.Helper()
+	cmd := &exec.Cmd{
+		Path: "/bin/sh",
+		Args: []string{"qemu-system-x86_64", "-c", script + "; : uuid=" + uuid},
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start fake QEMU: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return cmd.Process.Pid
+}
+
+// * answers QMP on path like QEMU does, status is what query-status reports
+type fakeQMP struct {
+	mu       sync.Mutex
+	status   string
+	commands []string
+	replies  map[string]string // * raw return value per command, {} otherwise
+}
+
+func serveFakeQMP(t *testing.T, path, status string) *fakeQMP {
+	t.Helper()
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", path, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	fake := &fakeQMP{status: status}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return fake
+}
+
+func (f *fakeQMP) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintln(conn, `{"QMP": {"version": {}, "capabilities": []}}`)
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var req struct {
+			Execute string `json:"execute"`
+		}
+		if err := decoder.Decode(&req); err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.commands = append(f.commands, req.Execute)
+		switch req.Execute {
+		case "stop":
+			f.status = "paused"
+		case "cont":
+			f.status = "running"
+		}
+		status := f.status
+		reply, ok := f.replies[req.Execute]
+		f.mu.Unlock()
+
+		switch {
+		case req.Execute == "query-status":
+			fmt.Fprintf(conn, `{"return": {"running": %v, "status": %q}}`+"\n", status == "running", status)
+		case ok:
+			fmt.Fprintf(conn, `{"return": %s}`+"\n", reply)
+		default:
+			fmt.Fprintln(conn, `{"return": {}}`)
+		}
+	}
+}
+
+func (f *fakeQMP) last() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.commands) == 0 {
+		return ""
+	}
+	return f.commands[len(f.commands)-1]
+}
+
+func (f *fakeQMP) setStatus(status string) {
+	f.mu.Lock()
+	f.status = status
+	f.mu.Unlock()
+}
+
+func TestLifecycle(t *testing.T) {
+	q := &Qemu{Folder: Folder{
+		Config:  t.TempDir(),
+		PID:     t.TempDir(),
+		Monitor: t.TempDir(),
+		State:   t.TempDir(),
+		Lock:    t.TempDir(),
+		Log:     t.TempDir(),
+	}}
+
+	uuid := "123e4567-e89b-12d3-a456-426614174000"
+	q.saveConfig(Config{ID: 101, Options: Options{UUID: uuid}})
+	pid := startFakeQemu(t, uuid)
+	os.WriteFile(filepath.Join(q.Folder.PID, "101.pid"), []byte(strconv.Itoa(pid)), 0644)
+	q.setState(101, StatusRunning, "started", func(s *State) { s.PID = pid })
+	fake := serveFakeQMP(t, q.qmpPath(101), "running")
+
+	expectStatus := func(want string) {
+		t.Helper()
+		if status, err := q.Status(101); err != nil || status != want {
+			t.Errorf("Expected status %s, got %s (%v)", want, status, err)
+		}
+	}
+
+	expectStatus(StatusRunning)
+
+	if err := q.Pause(101); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	if fake.last() != "stop" {
+		t.Errorf("Expected stop, got %s", fake.last())
+	}
+	expectStatus(StatusPaused)
+	if err := q.Pause(101); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Expected ErrInvalidState pausing twice, got %v", err)
+	}
+	if err := q.Reboot(101); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Expected ErrInvalidState rebooting a paused VM, got %v", err)
+	}
+
+	if err := q.Resume(101); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if fake.last() != "cont" {
+		t.Errorf("Expected cont, got %s", fake.last())
+	}
+	expectStatus(StatusRunning)
+	if err := q.Resume(101); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Expected ErrInvalidState resuming a running VM, got %v", err)
+	}
+
+	if err := q.Reset(101); err != nil || fake.last() != "system_reset" {
+		t.Errorf("Expected system_reset, got %s (%v)", fake.last(), err)
+	}
+
+	// * no guest agent socket
+	if err := q.Reboot(101); err != nil || fake.last() != "send-key" {
+		t.Errorf("Expected send-key fallback, got %s (%v)", fake.last(), err)
+	}
+
+	// * paused outside this package, e.g. by QEMU on an I/O error
+	fake.setStatus("paused")
+	expectStatus(StatusPaused)
+	fake.setStatus("running")
+	expectStatus(StatusRunning)
+
+	os.Remove(filepath.Join(q.Folder.PID, "101.pid"))
+	if err := q.Pause(101); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected ErrNotRunning without a process, got %v", err)
+	}
+}
+
+func TestReconcile_Locked(t *testing.T) {
+	folder := Folder{Config: t.TempDir(), PID: t.TempDir(), State: t.TempDir(), Lock: t.TempDir(), Log: t.TempDir(), Monitor: t.TempDir()}
+	q := &Qemu{Folder: folder}
+	other := &Qemu{Folder: folder} // * stands in for a process between spawning QEMU and writing its pid
+
+	q.saveConfig(Config{ID: 101, Options: Options{UUID: "123e4567-e89b-12d3-a456-426614174000"}})
+	q.setState(101, StatusStarting, "start requested", nil)
+
+	release, err := other.Lock(101, "start")
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+
+	report, err := q.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if state, _ := q.loadState(101); len(report.Stale) != 0 || state.Status != StatusStarting {
+		t.Errorf("Expected locked VM to be left alone, got %s, stale %v", state.Status, report.Stale)
+	}
+
+	release()
+	report, _ = q.Reconcile()
+	if state, _ := q.loadState(101); len(report.Stale) != 1 || state.Status != StatusCrashed {
+		t.Errorf("Expected VM to be marked crashed once unlocked, got %s, stale %v", state.Status, report.Stale)
+	}
+}
+
+func TestReconcile_Idle(t *testing.T) {
+	folder := Folder{Config: t.TempDir(), PID: t.TempDir(), State: t.TempDir(), Lock: t.TempDir(), Log: t.TempDir(), Monitor: t.TempDir()}
+	q := &Qemu{Folder: folder}
+
+	q.saveConfig(Config{ID: 101, Options: Options{UUID: "123e4567-e89b-12d3-a456-426614174000"}})
+	q.saveConfig(Config{ID: 102, Options: Options{UUID: "123e4567-e89b-12d3-a456-426614174001"}})
+	q.setState(101, StatusStopped, "stopped", nil)
+	q.setState(102, StatusRunning, "started", nil)
+
+	tests := []struct {
+		name    string
+		vmid    int
+		matched map[int]int
+		expect  string
+	}{
+		{"stopped", 101, nil, ""},
+		{"running without process", 102, nil, "stale"},
+		{"process without pid file", 102, map[int]int{102: 4242}, "adopt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if action, _ := q.reconcileAction(tt.vmid, tt.matched); action != tt.expect {
+				t.Errorf("Expected %q, got %q", tt.expect, action)
+			}
+		})
+	}
+}
+
+func TestStop_Kill(t *testing.T) {
+	q := &Qemu{Folder: Folder{
+		Config:  t.TempDir(),
+		PID:     t.TempDir(),
+		Monitor: t.TempDir(),
+		State:   t.TempDir(),
+		Lock:    t.TempDir(),
+		Log:     t.TempDir(),
+	}}
+
+	uuid := "123e4567-e89b-12d3-a456-426614174000"
+	q.saveConfig(Config{
+		ID:       101,
+		Hostname: "debian-101.vm",
+		Memory:   2048,
+		CPUs:     2,
+		Disks:    []Disk{{Path: "/tmp/101-0.qcow2"}},
+		OS:       "debian",
+		Options:  Options{UUID: uuid},
+	})
+	// * ignores SIGTERM like a wedged QEMU
+	pid := startFakeQemuScript(t, uuid, `trap "" TERM; while :; do sleep 1; done`)
+	pidPath := filepath.Join(q.Folder.PID, "101.pid")
+	os.WriteFile(pidPath, []byte(strconv.Itoa(pid)), 0644)
+	q.setState(101, StatusRunning, "started", func(s *State) { s.PID = pid })
+
+	defer func(timeout time.Duration) { stopTimeout = timeout }(stopTimeout)
+	stopTimeout = 500 * time.Millisecond
+
+	if err := q.Stop(101); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if q.isRunning(101, pid) {
+		t.Errorf("Expected process to be killed")
+	}
+	if _, err := os.Stat(pidPath); !os.IsNotExist(err) {
+		t.Errorf("Expected pid file to be removed once the process is gone, got %v", err)
+	}
+}
+
+func TestGetState_Starting(t *testing.T) {
+	folder := Folder{Config: t.TempDir(), PID: t.TempDir(), State: t.TempDir(), Lock: t.TempDir(), Log: t.TempDir()}
+	q := &Qemu{Folder: folder}
+	other := &Qemu{Folder: folder} // * stands in for a Start that has not written the pid file yet
+
+	q.setState(101, StatusStarting, "start requested", nil)
+	release, err := other.Lock(101, "start")
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+
+	if state := q.getState(context.Background(), 101, 0); state.Status != StatusStarting {
+		t.Errorf("Expected starting while the start holds the lock, got %s", state.Status)
+	}
+
+	release()
+	if state := q.getState(context.Background(), 101, 0); state.Status != StatusCrashed {
+		t.Errorf("Expected crashed once no start holds the lock, got %s", state.Status)
+	}
+}
+
+func TestAsyncTask(t *testing.T) {
+	q := &Qemu{Folder: Folder{Task: t.TempDir()}}
+
+	t.Run("Progress and success", func(t *testing.T) {
+		task, err := q.Async("test", 101, func(ctx context.Context) error {
+			setPhase(ctx, "copy")
+			progress := &Progress{Total: 8, ctx: ctx}
+			progress.Write([]byte("go-qemu!"))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Async failed: %v", err)
+		}
+
+		done, err := q.WaitTask(task.ID)
+		if err != nil {
+			t.Fatalf("WaitTask failed: %v", err)
+		}
+		if done.Status != TaskSucceeded {
+			t.Errorf("Expected status %s, got %s", TaskSucceeded, done.Status)
+		}
+		if done.Progress.Completed != 8 || done.Progress.Total != 8 {
+			t.Errorf("Unexpected progress: %+v", done.Progress)
+		}
+		if len(done.Log) == 0 {
+			t.Errorf("Expected task log entries")
+		}
+	})
+
+	t.Run("Cancellation", func(t *testing.T) {
+		started := make(chan struct{})
+		task, err := q.Async("test", 102, func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		if err != nil {
+			t.Fatalf("Async failed: %v", err)
+		}
+
+		<-started
+		if err := q.CancelTask(task.ID); err != nil {
+			t.Fatalf("CancelTask failed: %v", err)
+		}
+
+		done, _ := q.WaitTask(task.ID)
+		if done.Status != TaskCancelled {
+			t.Errorf("Expected status %s, got %s", TaskCancelled, done.Status)
+		}
+
+		persisted, err := q.loadTask(task.ID)
+		if err != nil || persisted.Status != TaskCancelled {
+			t.Errorf("Expected persisted cancelled task, got %+v (%v)", persisted, err)
+		}
+	})
+
+	t.Run("Result", func(t *testing.T) {
+		task, err := q.Async("create", 103, func(ctx context.Context) error {
+			taskFrom(ctx).setResult(&Instance{Password: "generated"})
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Async failed: %v", err)
+		}
+		q.taskMu.Lock()
+		running := q.tasks[task.ID]
+		q.taskMu.Unlock()
+		<-running.done
+
+		if tasks, _ := q.Tasks(); len(tasks) == 0 || tasks[0].Result == nil || tasks[0].Result.Password != "" {
+			t.Errorf("Expected listed result without password, got %+v", tasks)
+		}
+		first, err := q.Task(task.ID)
+		if err != nil || first.Result == nil || first.Result.Password != "generated" {
+			t.Fatalf("Expected password in the first read, got %+v (%v)", first, err)
+		}
+		second, err := q.Task(task.ID)
+		if err != nil || second.Result == nil || second.Result.Password != "" {
+			t.Errorf("Expected password only once, got %+v (%v)", second, err)
+		}
+	})
+}
+
+func TestDownloadOSImage_Cancel(t *testing.T) {
+	tempDir := t.TempDir()
+	q := &Qemu{Folder: Folder{Image: tempDir}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1048576")
+		w.WriteHeader(http.StatusOK)
+		w.Write(make([]byte, 1024))
+		w.(http.Flusher).Flush()
+		cancel()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	img := &Image{OS: "debian", Version: "12", Filename: "debian-12.qcow2", URL: server.URL}
+	_, err := q.downloadOSImage(ctx, img)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+		t.Errorf("Expected image and temp file to be removed, got %v", entries)
+	}
+}
+
+func TestDownloadOSImage_Concurrent(t *testing.T) {
+	tempDir := t.TempDir()
+	q := &Qemu{Folder: Folder{Image: tempDir}}
+
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Write([]byte("dummy image data"))
+	}))
+	defer server.Close()
+
+	img := &Image{OS: "debian", Version: "12", Filename: "debian-12.qcow2", URL: server.URL}
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = q.downloadOSImage(context.Background(), img)
+		}()
+	}
+
+	for requests.Load() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("download %d failed: %v", i, err)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected one request for the image, got %d", n)
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 1 || entries[0].Name() != "debian-12.qcow2" {
+		t.Errorf("Expected only the image, got %v", entries)
+	}
+}
+
+func TestObserver(t *testing.T) {
+	var events []Event
+	q := &Qemu{
+		Folder:   Folder{State: t.TempDir()},
+		Observer: ObserverFunc(func(e Event) { events = append(events, e) }),
+	}
+
+	q.setState(101, StatusRunning, "process started", nil)
+	progress := &Progress{Total: 4, qemu: q, vmid: 101, phase: "copy"}
+	progress.Write([]byte("qemu"))
+	q.warn(101, "failed to set VNC password", fmt.Errorf("timeout"))
+
+	expected := []Event{
+		{Type: EventLifecycle, VMID: 101, Message: "process started", From: StatusStopped, To: StatusRunning},
+		{Type: EventProgress, VMID: 101, Phase: "copy", Completed: 4, Total: 4},
+		{Type: EventWarning, VMID: 101, Message: "failed to set VNC password", Error: "timeout"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(events))
+	}
+	for i, want := range expected {
+		got := events[i]
+		got.At = time.Time{}
+		if got != want {
+			t.Errorf("Event %d: expected %+v, got %+v", i, want, got)
+		}
+	}
+
+	var buf strings.Builder
+	console := NewConsoleObserver(&buf)
+	for _, e := range events {
+		console.Notify(e)
+	}
+	want := "\r[*] copy: 0.00 MB / 0.00 MB (100.00%)\n[!] failed to set VNC password: timeout\n"
+	if buf.String() != want {
+		t.Errorf("Expected console output %q, got %q", want, buf.String())
+	}
+
+	// * console output is opt-in, a library must not write to stdout by default
+	if q, err := newQemu(WithPath(t.TempDir())); err != nil {
+		t.Errorf("newQemu failed: %v", err)
+	} else if q.Observer != nil {
+		t.Errorf("Expected no default observer, got %v", q.Observer)
+	}
+}
+
+func TestWithEnv(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), ".env")
+	os.WriteFile(envFile, []byte("GO_QEMU_PATH=/srv/go-qemu\nGO_QEMU_VMID_START=200\nGO_QEMU_VMID_END=299\nGO_QEMU_UBUNTU_VERSION=24.04\n"), 0644)
+	t.Setenv("GO_QEMU_VMID_END", "250")
+
+	q, err := newQemu(WithEnv(envFile), WithDefaultPassword("secret"))
+	if err != nil {
+		t.Fatalf("newQemu failed: %v", err)
+	}
+
+	if q.path != "/srv/go-qemu" {
+		t.Errorf("Expected path /srv/go-qemu, got %s", q.path)
+	}
+	if start, end := q.vmidRange(); start != 200 || end != 250 {
+		t.Errorf("Expected VMID range 200-250, got %d-%d", start, end)
+	}
+	if q.vmPassword() != "secret" {
+		t.Errorf("Expected password from option, got %s", q.vmPassword())
+	}
+	if _, err := q.getOSImageInfo("ubuntu", "22.04"); err == nil {
+		t.Errorf("Expected ubuntu 22.04 to be removed from the catalog")
+	}
+	if _, err := q.getOSImageInfo("debian", "12"); err != nil {
+		t.Errorf("Expected default debian catalog to remain: %v", err)
+	}
+
+	if _, err := newQemu(WithEnv(filepath.Join(t.TempDir(), "missing.env"))); err == nil {
+		t.Errorf("Expected error for an explicit missing file")
+	}
+	if _, err := newQemu(WithVMIDRange(500, 400)); err == nil {
+		t.Errorf("Expected error for an invalid VMID range")
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	dir := t.TempDir()
+	q := &Qemu{Folder: Folder{
+		VM:      dir,
+		Config:  dir,
+		Log:     dir,
+		PID:     dir,
+		Monitor: dir,
+		State:   dir,
+	}}
+
+	_, err := q.verifyConfig(context.Background(), Config{ID: 101})
+	var configErr *ConfigError
+	if !errors.Is(err, ErrInvalidConfig) || !errors.As(err, &configErr) || configErr.Field != "hostname" {
+		t.Errorf("Expected ConfigError for hostname, got %v", err)
+	}
+
+	if _, err := q.readConfig(101); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound from readConfig, got %v", err)
+	}
+
+	if err := q.Delete(101); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound from Delete, got %v", err)
+	}
+
+	if _, err := q.getOSImageInfo("debian", "10"); !errors.Is(err, ErrImageUnavailable) {
+		t.Errorf("Expected ErrImageUnavailable, got %v", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	folder := Folder{Config: t.TempDir(), Lock: t.TempDir()}
+	q := &Qemu{Folder: folder}
+	other := &Qemu{Folder: folder} // * stands in for another process
+
+	release, err := q.Lock(101, "backup")
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+
+	var lockErr *LockError
+	if _, _, err := other.lock(context.Background(), 101, "start"); !errors.As(err, &lockErr) || lockErr.Operation != "backup" {
+		t.Errorf("Expected LockError held by backup, got %v", err)
+	}
+	if _, _, err := q.lock(context.Background(), 101, "start"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked in process, got %v", err)
+	}
+	if holder := other.LockHolder(101); holder == nil || holder.Operation != "backup" || holder.PID != os.Getpid() {
+		t.Errorf("Unexpected lock holder: %+v", holder)
+	}
+
+	release()
+	if holder := other.LockHolder(101); holder != nil {
+		t.Errorf("Expected no holder after release, got %+v", holder)
+	}
+
+	ctx, unlock, err := other.lock(context.Background(), 101, "delete")
+	if err != nil {
+		t.Fatalf("lock after release failed: %v", err)
+	}
+	if _, nested, err := other.lock(ctx, 101, "stop"); err != nil {
+		t.Errorf("Expected nested lock to pass, got %v", err)
+	} else {
+		nested()
+	}
+	unlock()
+
+	t.Run("Concurrent VMID reservation", func(t *testing.T) {
+		var mu sync.Mutex
+		seen := make(map[int]bool)
+		var releases []func()
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(q *Qemu) {
+				defer wg.Done()
+				vmid, _, release, err := q.reserveVMID(context.Background(), "create")
+				if err != nil {
+					t.Errorf("reserveVMID failed: %v", err)
+					return
+				}
+				mu.Lock()
+				if seen[vmid] {
+					t.Errorf("VMID %d reserved twice", vmid)
+				}
+				seen[vmid] = true
+				// * a dropped release lets the GC close the lock file and free the VMID
+				releases = append(releases, release)
+				mu.Unlock()
+			}([]*Qemu{q, other}[i%2])
+		}
+		wg.Wait()
+		for _, release := range releases {
+			release()
+		}
+	})
+}
+
+func TestLock_Probe(t *testing.T) {
+	folder := Folder{Config: t.TempDir(), Lock: t.TempDir()}
+	q := &Qemu{Folder: folder}
+
+	release, err := q.Lock(101, "backup")
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	release()
+
+	// * a LockHolder probe from another process holds a shared flock for a moment
+	file, err := os.Open(q.lockPath(101))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer file.Close()
+	fd := int(file.Fd())
+	syscall.Flock(fd, syscall.LOCK_SH)
+	time.AfterFunc(lockRetryDelay, func() {
+		syscall.Flock(fd, syscall.LOCK_UN)
+	})
+
+	other := &Qemu{Folder: folder}
+	release, err = other.Lock(101, "start")
+	if err != nil {
+		t.Fatalf("Expected lock to outlast the probe, got %v", err)
+	}
+	release()
+
+	// * idle VMs are not probed at all
+	if holder := other.LockHolder(101); holder != nil {
+		t.Errorf("Expected no holder, got %+v", holder)
+	}
+}
+
+func TestAbortCreate(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keep=%v", keep), func(t *testing.T) {
+			dir := t.TempDir()
+			q := &Qemu{Folder: Folder{VM: dir, Config: t.TempDir(), State: t.TempDir()}, keepArtifacts: keep}
+
+			rb := &rollback{}
+			q.setState(101, StatusCreating, "create requested", nil)
+			rb.add("state", func() error { return q.deleteState(101) })
+
+			diskPath := filepath.Join(dir, "101-0.qcow2")
+			os.WriteFile(diskPath, []byte("disk"), 0644)
+			rb.add("disk", func() error { return os.Remove(diskPath) })
+
+			q.saveConfig(Config{ID: 101})
+			rb.add("config", func() error { return q.deleteConfig(101) })
+
+			var order []string
+			rb.add("marker", func() error {
+				order = append(order, "marker")
+				return nil
+			})
+
+			q.abortCreate(context.Background(), 101, rb, fmt.Errorf("failed to start VM"))
+
+			_, diskErr := os.Stat(diskPath)
+			_, configErr := q.readConfig(101)
+			state, stateErr := q.loadState(101)
+			if keep {
+				if diskErr != nil || configErr != nil || stateErr != nil {
+					t.Fatalf("Expected artifacts to be kept: %v %v %v", diskErr, configErr, stateErr)
+				}
+				if state.Status != StatusStopped || state.ExitReason != "failed to start VM" {
+					t.Errorf("Unexpected state: %s %q", state.Status, state.ExitReason)
+				}
+				if len(order) != 0 {
+					t.Errorf("Expected no undo to run")
+				}
+				return
+			}
+
+			if !os.IsNotExist(diskErr) || !errors.Is(configErr, ErrNotFound) || !errors.Is(stateErr, ErrNotFound) {
+				t.Errorf("Expected artifacts to be removed: %v %v %v", diskErr, configErr, stateErr)
+			}
+			if len(order) != 1 {
+				t.Errorf("Expected undo to run once, got %v", order)
+			}
+		})
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	dir := t.TempDir()
+	q := &Qemu{Folder: Folder{Config: dir, State: t.TempDir(), PID: t.TempDir()}}
+
+	config := Config{
+		ID:       101,
+		Hostname: "debian-101.vm",
+		Memory:   2048,
+		CPUs:     2,
+		Disks:    []Disk{{Path: "/tmp/101-0.qcow2"}},
+		OS:       "debian",
+		Options:  Options{UUID: "test-uuid"},
+	}
+	q.saveConfig(config)
+
+	memory, cpus := 1024, 0
+	if err := q.updateConfig(context.Background(), 101, config, ConfigPatch{CPUs: &cpus}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig, got %v", err)
+	}
+
+	policy := RestartPolicy{Policy: RestartAlways}
+	if err := q.updateConfig(context.Background(), 101, config, ConfigPatch{Memory: &memory, Restart: &policy}); err != nil {
+		t.Fatalf("updateConfig failed: %v", err)
+	}
+
+	updated, _ := q.readConfig(101)
+	if updated.Memory != 1024 || updated.Restart.Policy != RestartAlways || updated.CPUs != 2 {
+		t.Errorf("Unexpected config after update: %+v", updated)
+	}
+
+	data, err := q.storage().Get(KindConfig, priorConfigKey(101))
+	if err != nil || !strings.Contains(string(data), `"memory": 2048`) {
+		t.Errorf("Expected prior config to be kept, got %s, %v", data, err)
+	}
+
+	if ids, _ := q.usedVMIDs(); len(ids) != 1 {
+		t.Errorf("Prior config must not count as a VM: %v", ids)
+	}
+
+	// * stopped VM, nothing is left pending
+	if state, err := q.loadState(101); err == nil && len(state.Pending) > 0 {
+		t.Errorf("Unexpected pending fields: %v", state.Pending)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestUpdateConfig_Live(t *testing.T) {
+	q := &Qemu{Folder: Folder{
+		Config:  t.TempDir(),
+		PID:     t.TempDir(),
+		Monitor: t.TempDir(),
+		State:   t.TempDir(),
+	}}
+
+	uuid := "123e4567-e89b-12d3-a456-426614174000"
+	config := Config{
+		ID:       101,
+		Hostname: "debian-101.vm",
+		Memory:   4096,
+		CPUs:     2,
+		Disks:    []Disk{{Path: "/tmp/101-0.qcow2"}},
+		OS:       "debian",
+		Options:  Options{UUID: uuid},
+	}
+	q.saveConfig(config)
+	pid := startFakeQemu(t, uuid)
+	os.WriteFile(filepath.Join(q.Folder.PID, "101.pid"), []byte(strconv.Itoa(pid)), 0644)
+	q.setState(101, StatusRunning, "started", func(s *State) { s.PID = pid })
+	fake := serveFakeQMP(t, q.qmpPath(101), "running")
+	fake.mu.Lock()
+	fake.replies = map[string]string{"query-memory-size-summary": `{"base-memory": 4294967296}`}
+	fake.mu.Unlock()
+
+	update := func(patch ConfigPatch) []string {
+		t.Helper()
+		current, _ := q.readConfig(101)
+		if err := q.updateConfig(context.Background(), 101, *current, patch); err != nil {
+			t.Fatalf("updateConfig failed: %v", err)
+		}
+		state, _ := q.loadState(101)
+		return state.Pending
+	}
+
+	steps := []struct {
+		name    string
+		patch   ConfigPatch
+		pending []string
+		last    string
+	}{
+		{"Shrink", ConfigPatch{Memory: ptr(2048)}, nil, "balloon"},
+		{"Grow within booted size", ConfigPatch{Memory: ptr(3072)}, nil, "balloon"},
+		{"Grow past booted size", ConfigPatch{Memory: ptr(8192)}, []string{"memory"}, "query-memory-size-summary"},
+		{"Back within booted size", ConfigPatch{Memory: ptr(4096)}, nil, "balloon"},
+		{"Hostname", ConfigPatch{Hostname: ptr("renamed.vm")}, []string{"hostname"}, "balloon"},
+	}
+	for _, step := range steps {
+		if pending := update(step.patch); !slices.Equal(pending, step.pending) {
+			t.Errorf("%s: expected pending %v, got %v", step.name, step.pending, pending)
+		}
+		if fake.last() != step.last {
+			t.Errorf("%s: expected last QMP command %s, got %s", step.name, step.last, fake.last())
+		}
+	}
+}
+
+func TestReadConfig_Migrate(t *testing.T) {
+	dir := t.TempDir()
+	q := &Qemu{Folder: Folder{Config: dir}}
+
+	legacy := `{
+  "id": 101,
+  "hostname": "debian-101.vm",
+  "memory": 2048,
+  "disk_path": "/tmp/101-0.qcow2",
+  "network": ["bridge=vmbr1,model=virtio-net-pci,vlan=10,mac_address=52:54:00:00:00:65,firewall=0,disconnect=0,mtu=9000,rate_limit=0,multiqueue=0"]
+}`
+	os.WriteFile(filepath.Join(dir, "101.json"), []byte(legacy), 0644)
+
+	config, err := q.readConfig(101)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+
+	if len(config.Disks) != 1 || config.Disks[0].Path != "/tmp/101-0.qcow2" || config.Disks[0].Format != "qcow2" {
+		t.Errorf("Unexpected disks: %+v", config.Disks)
+	}
+	expected := Network{Bridge: "vmbr1", Model: "virtio-net-pci", Vlan: 10, MACAddress: "52:54:00:00:00:65", MTU: 9000}
+	if len(config.Network) != 1 || config.Network[0] != expected {
+		t.Errorf("Unexpected network: %+v", config.Network)
+	}
+	if config.SchemaVersion != configSchema {
+		t.Errorf("Expected schema %d, got %d", configSchema, config.SchemaVersion)
+	}
+
+	backup, err := os.ReadFile(filepath.Join(dir, "101.v0.bak.json"))
+	if err != nil || string(backup) != legacy {
+		t.Errorf("Expected untouched backup, got %q, %v", backup, err)
+	}
+
+	saved, _ := os.ReadFile(filepath.Join(dir, "101.json"))
+	if strings.Contains(string(saved), "disk_path") || !strings.Contains(string(saved), fmt.Sprintf(`"schema_version": %d`, configSchema)) {
+		t.Errorf("Expected migrated file on disk, got %s", saved)
+	}
+
+	if ids, _ := q.usedVMIDs(); len(ids) != 1 {
+		t.Errorf("Backup must not count as a VM: %v", ids)
+	}
+
+	os.WriteFile(filepath.Join(dir, "102.json"), []byte(`{"id": 102, "schema_version": 99}`), 0644)
+	if _, err := q.readConfig(102); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig for a newer schema, got %v", err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	bolt, err := NewBoltStore(filepath.Join(dir, "go-qemu.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore failed: %v", err)
+	}
+
+	stores := map[string]Store{
+		"dir":  NewDirStore(Folder{Config: t.TempDir(), State: t.TempDir(), Task: t.TempDir()}),
+		"bolt": bolt,
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			q := &Qemu{store: store}
+
+			if _, err := store.Get(KindConfig, "101"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound, got %v", err)
+			}
+
+			q.saveConfig(Config{ID: 101, Hostname: "debian-101.vm"})
+			q.saveConfig(Config{ID: 102})
+			store.Put(KindConfig, priorConfigKey(101), []byte(`{"id": 101}`))
+			store.Put(KindState, "101", []byte(`{"status": "stopped"}`))
+
+			ids, err := q.configIDs()
+			if err != nil || !slices.Equal(ids, []int{101, 102}) {
+				t.Errorf("Expected VMIDs [101 102], got %v, %v", ids, err)
+			}
+
+			config, err := q.readConfig(101)
+			if err != nil || config.Hostname != "debian-101.vm" {
+				t.Errorf("Unexpected config: %+v, %v", config, err)
+			}
+
+			if err := q.deleteConfig(101); err != nil {
+				t.Errorf("deleteConfig failed: %v", err)
+			}
+			if err := q.deleteConfig(101); err != nil {
+				t.Errorf("Deleting a missing key must not fail: %v", err)
+			}
+			if _, err := q.readConfig(101); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound after delete, got %v", err)
+			}
+
+			// * kinds do not share keys
+			if state, err := q.loadState(101); err != nil || state.Status != StatusStopped {
+				t.Errorf("Unexpected state: %+v, %v", state, err)
+			}
+		})
+	}
+
+	// * nothing is held between operations, another process gets the file right away
+	db, err := bbolt.Open(filepath.Join(dir, "go-qemu.db"), 0644, &bbolt.Options{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Expected the file to be free between operations, got %v", err)
+	}
+	db.Close()
+
+	shared, err := NewBoltStore(filepath.Join(dir, ".", "go-qemu.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore on the same file failed: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store := []Store{bolt, shared}[i%2]
+			if err := store.Put(KindTask, strconv.Itoa(i), []byte("{}")); err != nil {
+				t.Errorf("Put failed: %v", err)
+			}
+			if _, err := store.Keys(KindTask); err != nil {
+				t.Errorf("Keys failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEnsureCloudInit(t *testing.T) {
+	q := &Qemu{Folder: Folder{VM: t.TempDir(), Config: t.TempDir()}}
+
+	config := Config{
+		ID:       101,
+		Hostname: "debian-101.vm",
+		OS:       "debian",
+		Disks:    []Disk{{Path: "/tmp/101-0.qcow2"}},
+		Options:  Options{UUID: "test-uuid"},
+		CloudInit: CloudInit{
+			Username:      "debian",
+			Password:      "passwd",
+			AuthorizedKey: "ssh-ed25519 AAAAtest",
+		},
+	}
+
+	files, err := q.renderCloudInit(config)
+	if err != nil {
+		t.Fatalf("renderCloudInit failed: %v", err)
+	}
+	if !strings.Contains(files["user-data"], "ssh-ed25519 AAAAtest") || !strings.Contains(files["meta-data"], "test-uuid") {
+		t.Errorf("Unexpected cloud-init files: %v", files)
+	}
+
+	// * an ISO matching the saved hash is left alone, no genisoimage needed
+	os.WriteFile(q.cloudInitPath(101), []byte("iso"), 0644)
+	config.CloudInitPath = q.cloudInitPath(101)
+	config.CloudInitHash = cloudInitHash(files)
+	if changed, err := q.ensureCloudInit(context.Background(), &config); changed || err != nil {
+		t.Errorf("Expected ISO to be kept, got changed=%v, %v", changed, err)
+	}
+
+	changedConfig := config
+	changedConfig.CloudInit.Password = "changed"
+	changedFiles, _ := q.renderCloudInit(changedConfig)
+	if cloudInitHash(changedFiles) == config.CloudInitHash {
+		t.Error("Expected hash to change with cloud-init inputs")
+	}
+
+	// * loading never rebuilds the ISO
+	q.saveConfig(config)
+	os.Remove(q.cloudInitPath(101))
+	if _, err := q.loadConfig(context.Background(), 101); err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if _, err := os.Stat(q.cloudInitPath(101)); !os.IsNotExist(err) {
+		t.Errorf("loadConfig must not create the ISO: %v", err)
+	}
+}
+
+func TestWriteISO(t *testing.T) {
+	files := map[string]string{
+		"meta-data":      "instance-id: test-uuid\n",
+		"user-data":      "#cloud-config\n",
+		"network-config": "version: 2\n",
+	}
+
+	var buf bytes.Buffer
+	if err := writeISO(&buf, "cidata", files, time.Now()); err != nil {
+		t.Fatalf("writeISO failed: %v", err)
+	}
+	image := buf.Bytes()
+	sector := func(n uint32) []byte {
+		return image[int(n)*isoSectorSize : int(n+1)*isoSectorSize]
+	}
+
+	// * records of a single-sector directory: name from NM or Joliet, content from extent
+	readDir := func(dir []byte, joliet bool) map[string]string {
+		found := make(map[string]string)
+		for offset := 0; offset < len(dir) && dir[offset] > 0; offset += int(dir[offset]) {
+			record := dir[offset : offset+int(dir[offset])]
+			nameLen := int(record[32])
+			identifier := record[33 : 33+nameLen]
+			if nameLen == 1 && identifier[0] <= 1 {
+				continue
+			}
+
+			var name string
+			if joliet {
+				for i := 0; i+1 < len(identifier); i += 2 {
+					name += string(rune(binary.BigEndian.Uint16(identifier[i:])))
+				}
+				name = strings.TrimSuffix(name, ";1")
+			} else {
+				use := record[33+nameLen+(nameLen+1)%2:]
+				for i := 0; i+4 <= len(use) && use[i+2] >= 4; i += int(use[i+2]) {
+					if string(use[i:i+2]) == "NM" {
+						name = string(use[i+5 : i+int(use[i+2])])
+					}
+				}
+			}
+
+			extent := binary.LittleEndian.Uint32(record[2:])
+			size := binary.LittleEndian.Uint32(record[10:])
+			found[name] = string(image[int(extent)*isoSectorSize : int(extent)*isoSectorSize+int(size)])
+		}
+		return found
+	}
+
+	pvd := sector(isoPVDSector)
+	if pvd[0] != 1 || string(pvd[1:6]) != "CD001" || strings.TrimSpace(string(pvd[40:72])) != "cidata" {
+		t.Fatalf("Unexpected primary volume descriptor: %q", pvd[:72])
+	}
+	if size := binary.LittleEndian.Uint32(pvd[80:]); int(size)*isoSectorSize != len(image) {
+		t.Errorf("Expected volume size %d, got %d sectors", len(image)/isoSectorSize, size)
+	}
+	root := binary.LittleEndian.Uint32(pvd[156+2:])
+	if got := readDir(sector(root), false); !reflect.DeepEqual(got, files) {
+		t.Errorf("Unexpected Rock Ridge files: %v", got)
+	}
+
+	// * Rock Ridge is announced by SP on "." and the ER in its continuation area
+	dot := sector(root)
+	if use := dot[34:]; string(use[:2]) != "SP" {
+		t.Errorf("Expected SP entry on root, got %q", use[:2])
+	}
+	if !bytes.Contains(sector(isoCESector), []byte(rripID)) {
+		t.Error("Expected RRIP_1991A extension reference")
+	}
+
+	svd := sector(isoSVDSector)
+	if svd[0] != 2 || string(svd[88:91]) != "%/E" {
+		t.Fatalf("Unexpected Joliet volume descriptor: %q", svd[:91])
+	}
+	jolietRoot := binary.LittleEndian.Uint32(svd[156+2:])
+	if got := readDir(sector(jolietRoot), true); !reflect.DeepEqual(got, files) {
+		t.Errorf("Unexpected Joliet files: %v", got)
+	}
+
+	if sector(isoTerminator)[0] != 255 {
+		t.Error("Expected volume descriptor set terminator")
+	}
+}
+
+func TestSeedHandler(t *testing.T) {
+	q := &Qemu{Folder: Folder{VM: t.TempDir(), Config: t.TempDir()}}
+	if err := WithSeedURL("http://192.168.100.1:8686/")(q); err != nil {
+		t.Fatalf("WithSeedURL failed: %v", err)
+	}
+	if err := WithSeedURL("192.168.100.1:8686")(q); err == nil {
+		t.Error("Expected error for a seed URL without scheme")
+	}
+
+	config := Config{
+		ID:      101,
+		OS:      "debian",
+		Disks:   []Disk{{Path: "/tmp/101-0.qcow2", Format: "qcow2"}},
+		Options: Options{UUID: "test-uuid"},
+		CloudInit: CloudInit{
+			Password:      "passwd",
+			AuthorizedKey: "ssh-ed25519 AAAAtest",
+		},
+	}
+	q.saveConfig(config)
+
+	// * no ISO with a seed URL, the guest is pointed at the server instead
+	if changed, err := q.ensureCloudInit(context.Background(), &config); changed || err != nil {
+		t.Errorf("Expected no ISO, got changed=%v, %v", changed, err)
+	}
+	args := strings.Join(q.verifyArgs(config), " ")
+	if !strings.Contains(args, "type=1,uuid=test-uuid,serial=ds=nocloud-net;s=http://192.168.100.1:8686/test-uuid/") {
+		t.Errorf("Expected seed serial in args: %s", args)
+	}
+	if strings.Contains(args, "media=cdrom") {
+		t.Errorf("Expected no cloud-init CD-ROM: %s", args)
+	}
+
+	server := httptest.NewServer(q.SeedHandler())
+	defer server.Close()
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/test-uuid/meta-data", http.StatusOK, "instance-id: test-uuid"},
+		{"/test-uuid/user-data", http.StatusOK, "ssh-ed25519 AAAAtest"},
+		{"/test-uuid/vendor-data", http.StatusOK, ""},
+		{"/test-uuid/network-config", http.StatusNotFound, ""},
+		{"/test-uuid/secrets", http.StatusNotFound, ""},
+		{"/other-uuid/meta-data", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(server.URL + tt.path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", tt.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || !strings.Contains(string(body), tt.want) {
+			t.Errorf("GET %s: got %d %q", tt.path, resp.StatusCode, body)
+		}
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite testdata golden files")
+
+func TestRenderCloudInit_Golden(t *testing.T) {
+	q := &Qemu{}
+
+	for _, osName := range []string{"ubuntu", "debian", "centos", "rockylinux", "almalinux"} {
+		t.Run(osName, func(t *testing.T) {
+			config := Config{
+				ID:      101,
+				OS:      osName,
+				Options: Options{UUID: "2f1c9a8e-4b7d-4c1e-9f3a-6d5e8b0a7c21"},
+				CloudInit: CloudInit{
+					Hostname:      osName + "-101.vm",
+					Password:      "passwd",
+					AuthorizedKey: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAITest user@host",
+					DNSDomain:     "vm.local",
+					DNSServers:    []string{"1.1.1.1", "8.8.8.8"},
+					IPv4:          "mode=static,address=192.168.100.101/24,gateway=192.168.100.1",
+					IPv6:          "mode=slaac",
+				},
+			}
+
+			files, err := q.renderCloudInit(config)
+			if err != nil {
+				t.Fatalf("renderCloudInit failed: %v", err)
+			}
+
+			for _, name := range []string{"meta-data", "user-data", "network-config"} {
+				path := filepath.Join("testdata", "cloud-init", osName, name)
+				if *updateGolden {
+					os.MkdirAll(filepath.Dir(path), 0755)
+					if err := os.WriteFile(path, []byte(files[name]), 0644); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+
+				want, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("missing golden file, run with -update: %v", err)
+				}
+				if files[name] != string(want) {
+					t.Errorf("%s differs from %s:\n%s", name, path, files[name])
+				}
+			}
+		})
+	}
+}
+
+func TestRenderCloudInit_Escaping(t *testing.T) {
+	q := &Qemu{}
+	config := Config{
+		ID:      101,
+		OS:      "debian",
+		Options: Options{UUID: "test-uuid"},
+		CloudInit: CloudInit{
+			Hostname:      "host\nruncmd: [reboot]",
+			Password:      "p@ss: #word",
+			AuthorizedKey: "ssh-ed25519 AAAAtest",
+		},
+	}
+
+	files, err := q.renderCloudInit(config)
+	if err != nil {
+		t.Fatalf("renderCloudInit failed: %v", err)
+	}
+
+	var metaData map[string]any
+	if err := yaml.Unmarshal([]byte(files["meta-data"]), &metaData); err != nil {
+		t.Fatalf("meta-data is not valid YAML: %v", err)
+	}
+	if len(metaData) != 2 || metaData["local-hostname"] != config.CloudInit.Hostname {
+		t.Errorf("Hostname leaked into meta-data: %v", metaData)
+	}
+
+	var userData cloudConfig
+	if err := yaml.Unmarshal([]byte(files["user-data"]), &userData); err != nil {
+		t.Fatalf("user-data is not valid YAML: %v", err)
+	}
+	if strings.Contains(files["user-data"], "p@ss") || userData.Users[0].Passwd != sha512Crypt("p@ss: #word", stableSalt("test-uuid\x00debian"), 0) {
+		t.Errorf("Expected only the password hash in user-data: %+v", userData.Users[0])
+	}
+
+	for field, cloudInit := range map[string]CloudInit{
+		"cloud_init.passwd":   {Password: "passwd\nroot:root"},
+		"cloud_init.username": {Username: "root:x"},
+	} {
+		config.CloudInit = cloudInit
+		var configErr *ConfigError
+		if _, err := q.renderCloudInit(config); !errors.As(err, &configErr) || configErr.Field != field {
+			t.Errorf("Expected ConfigError for %s, got %v", field, err)
+		}
+	}
+}
+
+func TestRenderUserData(t *testing.T) {
+	q := &Qemu{}
+	base := Config{
+		ID:      101,
+		OS:      "debian",
+		Options: Options{UUID: "test-uuid"},
+		CloudInit: CloudInit{
+			Password:      "passwd",
+			AuthorizedKey: "ssh-ed25519 AAAAtest",
+			Packages:      []string{"nginx", "qemu-guest-agent"},
+			WriteFiles: []WriteFile{
+				{Path: "/etc/motd", Content: "hello\n", Permissions: "0644"},
+				{Path: "/opt/blob", Content: "AAEC", Base64: true, Owner: "root:root"},
+			},
+			Bootcmd: []string{"echo boot"},
+			Runcmd:  []string{"systemctl restart nginx"},
+		},
+	}
+
+	render := func(config Config) ([]map[string]any, []userDataPart) {
+		t.Helper()
+		files, err := q.renderCloudInit(config)
+		if err != nil {
+			t.Fatalf("renderCloudInit failed: %v", err)
+		}
+		again, _ := q.renderCloudInit(config)
+		if files["user-data"] != again["user-data"] {
+			t.Error("Expected user-data to render the same twice")
+		}
+		configs, parts, err := parseUserData(files["user-data"])
+		if err != nil || len(configs) != 1 {
+			t.Fatalf("Unexpected user-data %q: %v", files["user-data"], err)
+		}
+		return configs, parts
+	}
+	list := func(value any) string {
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+
+	configs, parts := render(base)
+	if got := list(configs[0]["packages"]); got != `["qemu-guest-agent","nginx"]` {
+		t.Errorf("Unexpected packages: %s", got)
+	}
+	if got := list(configs[0]["write_files"]); !strings.Contains(got, `"encoding":"b64"`) || !strings.Contains(got, `"path":"/etc/motd"`) {
+		t.Errorf("Unexpected write_files: %s", got)
+	}
+	runcmd, _ := configs[0]["runcmd"].([]any)
+	if len(runcmd) != 5 || runcmd[4] != "systemctl restart nginx" || list(configs[0]["bootcmd"]) != `["echo boot"]` {
+		t.Errorf("Unexpected commands: %s %s", list(runcmd), list(configs[0]["bootcmd"]))
+	}
+	if len(parts) != 0 {
+		t.Errorf("Expected plain #cloud-config, got %d extra parts", len(parts))
+	}
+
+	// * raw #cloud-config is merged, lists appended and scalars added
+	config := base
+	config.CloudInit.UserData = "#cloud-config\ntimezone: Asia/Taipei\npackages: [htop, nginx]\nruncmd:\n  - echo raw\n"
+	configs, _ = render(config)
+	if got := list(configs[0]["packages"]); got != `["qemu-guest-agent","nginx","htop"]` || configs[0]["timezone"] != "Asia/Taipei" {
+		t.Errorf("Unexpected merge: %s %v", got, configs[0]["timezone"])
+	}
+	if runcmd, _ := configs[0]["runcmd"].([]any); len(runcmd) != 6 || runcmd[5] != "echo raw" {
+		t.Errorf("Unexpected merged runcmd: %s", list(runcmd))
+	}
+
+	// * a script becomes a second MIME part after the generated config
+	config.CloudInit.UserData = "#!/bin/sh\necho script\n"
+	configs, parts = render(config)
+	if len(parts) != 1 || parts[0].mimeType != "text/x-shellscript" || parts[0].content != config.CloudInit.UserData {
+		t.Errorf("Unexpected parts: %+v", parts)
+	}
+	if !strings.Contains(list(configs[0]["packages"]), "qemu-guest-agent") {
+		t.Error("Expected qemu-guest-agent to survive the multipart merge")
+	}
+
+	// * multipart input: cloud-config parts merged, base64 parts decoded
+	config.CloudInit.UserData = "Content-Type: multipart/mixed; boundary=\"XYZ\"\nMIME-Version: 1.0\n\n" +
+		"--XYZ\nContent-Type: text/cloud-config\n\n#cloud-config\npackages: [curl]\n" +
+		"--XYZ\nContent-Type: text/x-shellscript\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString([]byte("#!/bin/sh\necho mime\n")) + "\n--XYZ--\n"
+	configs, parts = render(config)
+	if !strings.Contains(list(configs[0]["packages"]), "curl") || len(parts) != 1 || parts[0].content != "#!/bin/sh\necho mime\n" {
+		t.Errorf("Unexpected multipart merge: %s %+v", list(configs[0]["packages"]), parts)
+	}
+
+	for field, cloudInit := range map[string]CloudInit{
+		"cloud_init.write_files[0].path":        {WriteFiles: []WriteFile{{Path: "etc/motd"}}},
+		"cloud_init.write_files[0].permissions": {WriteFiles: []WriteFile{{Path: "/etc/motd", Permissions: "rw-r--r--"}}},
+		"cloud_init.write_files[0].content":     {WriteFiles: []WriteFile{{Path: "/etc/motd", Content: "%%", Base64: true}}},
+		"cloud_init.packages[0]":                {Packages: []string{"vim; reboot"}},
+		"cloud_init.user_data":                  {UserData: "hello"},
+	} {
+		config := base
+		config.CloudInit = cloudInit
+		var configErr *ConfigError
+		if _, err := q.renderCloudInit(config); !errors.As(err, &configErr) || configErr.Field != field {
+			t.Errorf("Expected ConfigError for %s, got %v", field, err)
+		}
+	}
+}
+
+func TestImportSSHKeys(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "octocat.keys"), []byte("ssh-ed25519 AAAAone\n# comment\n\nssh-rsa AAAAtwo\n"), 0644)
+
+	q := &Qemu{}
+	if err := WithKeySource(filepath.Join(dir, "%s.keys"))(q); err != nil {
+		t.Fatalf("WithKeySource failed: %v", err)
+	}
+	if err := WithKeySource("https://example.com/keys")(&Qemu{}); err == nil {
+		t.Error("Expected error for a key source without a name placeholder")
+	}
+
+	cloudInit := CloudInit{
+		AuthorizedKey: "ssh-ed25519 AAAAlocal",
+		ImportKeys:    []string{"gh:octocat"},
+		Users:         []User{{Name: "ops", SSHKeys: []string{"ssh-rsa AAAAtwo"}, ImportKeys: []string{"gh:octocat"}}},
+	}
+	for range 2 {
+		if err := q.importSSHKeys(context.Background(), &cloudInit); err != nil {
+			t.Fatalf("importSSHKeys failed: %v", err)
+		}
+	}
+	if cloudInit.AuthorizedKey != "ssh-ed25519 AAAAlocal\nssh-ed25519 AAAAone\nssh-rsa AAAAtwo" {
+		t.Errorf("Unexpected authorized keys: %q", cloudInit.AuthorizedKey)
+	}
+	if !slices.Equal(cloudInit.Users[0].SSHKeys, []string{"ssh-rsa AAAAtwo", "ssh-ed25519 AAAAone"}) {
+		t.Errorf("Unexpected user keys: %v", cloudInit.Users[0].SSHKeys)
+	}
+
+	// * the same over HTTP, as github.com/<name>.keys serves them
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+	WithKeySource(server.URL + "/%s.keys")(q)
+	keys, err := q.fetchSSHKeys(context.Background(), "import_keys", []string{"gh:octocat"})
+	if err != nil || len(keys) != 2 {
+		t.Errorf("Expected 2 keys over HTTP, got %v, %v", keys, err)
+	}
+
+	if _, err := q.fetchSSHKeys(context.Background(), "import_keys", []string{"gh:missing"}); err == nil {
+		t.Error("Expected error for an unknown user")
+	}
+	var configErr *ConfigError
+	if _, err := q.fetchSSHKeys(context.Background(), "import_keys", []string{"octocat"}); !errors.As(err, &configErr) {
+		t.Errorf("Expected ConfigError without gh: prefix, got %v", err)
+	}
+
+	// * no key at all, rendering leaves ~/.ssh alone and import saves the host user's key
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if _, err := q.renderCloudInit(Config{OS: "debian", Options: Options{UUID: "test-uuid"}}); err != nil {
+		t.Fatalf("renderCloudInit failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".ssh")); !os.IsNotExist(err) {
+		t.Errorf("Expected rendering not to touch ~/.ssh, got %v", err)
+	}
+	os.MkdirAll(filepath.Join(home, ".ssh"), 0700)
+	os.WriteFile(filepath.Join(home, ".ssh", "id_ed25519.pub"), []byte("ssh-ed25519 AAAAhost user@host\n"), 0644)
+	fallback := CloudInit{}
+	if err := q.importSSHKeys(context.Background(), &fallback); err != nil || fallback.AuthorizedKey != "ssh-ed25519 AAAAhost user@host" {
+		t.Errorf("Expected host key to be saved, got %q, %v", fallback.AuthorizedKey, err)
+	}
+}
+
+func TestRenderCloudInit_Users(t *testing.T) {
+	q := &Qemu{}
+	locked := false
+	config := Config{
+		ID:      101,
+		OS:      "debian",
+		Options: Options{UUID: "test-uuid"},
+		CloudInit: CloudInit{
+			Password: "passwd",
+			Users: []User{
+				{
+					Name:         "ops",
+					Groups:       []string{"adm", "sudo"},
+					Sudo:         "ALL=(ALL) NOPASSWD:ALL",
+					SSHKeys:      []string{"ssh-ed25519 AAAAone", "ssh-rsa AAAAtwo"},
+					LockPasswd:   &locked,
+					HashedPasswd: "$6$salt$hash",
+				},
+				{Name: "deploy", Shell: "/bin/sh", SSHKeys: []string{"ssh-ed25519 AAAAthree"}},
+			},
+		},
+	}
+
+	files, err := q.renderCloudInit(config)
+	if err != nil {
+		t.Fatalf("renderCloudInit failed: %v", err)
+	}
+	var userData cloudConfig
+	if err := yaml.Unmarshal([]byte(files["user-data"]), &userData); err != nil {
+		t.Fatalf("user-data is not valid YAML: %v", err)
+	}
+
+	if len(userData.Users) != 2 {
+		t.Fatalf("Expected 2 users, got %+v", userData)
+	}
+	ops, deploy := userData.Users[0], userData.Users[1]
+	if ops.Groups != "adm,sudo" || len(ops.SSHAuthorizedKeys) != 2 || ops.LockPasswd == nil || *ops.LockPasswd || ops.Passwd != "$6$salt$hash" || ops.Shell != "/bin/bash" {
+		t.Errorf("Unexpected ops user: %+v", ops)
+	}
+	if deploy.Sudo != "" || deploy.Shell != "/bin/sh" || deploy.LockPasswd != nil {
+		t.Errorf("Unexpected deploy user: %+v", deploy)
+	}
+
+	for field, user := range map[string]User{
+		"cloud_init.users[0].name":          {Name: "Root"},
+		"cloud_init.users[0].sudo":          {Name: "ops", Sudo: "ALL=(ALL) ALL\nops ALL=(ALL) NOPASSWD:ALL"},
+		"cloud_init.users[0].groups":        {Name: "ops", Groups: []string{"adm,wheel"}},
+		"cloud_init.users[0].shell":         {Name: "ops", Shell: "bash"},
+		"cloud_init.users[0].hashed_passwd": {Name: "ops", HashedPasswd: "plaintext"},
+	} {
+		config.CloudInit.Users = []User{user}
+		var configErr *ConfigError
+		if _, err := q.renderCloudInit(config); !errors.As(err, &configErr) || configErr.Field != field {
+			t.Errorf("Expected ConfigError for %s, got %v", field, err)
+		}
+	}
+}
+
+func TestRenderCloudInit_UserLockPasswd(t *testing.T) {
+	q := &Qemu{}
+	locked := true
+
+	tests := []struct {
+		name   string
+		user   User
+		expect *bool
+	}{
+		{"password", User{Name: "ops", Password: "secret"}, ptr(false)},
+		{"hashed password", User{Name: "ops", HashedPasswd: "$6$salt$hash"}, ptr(false)},
+		{"explicit lock", User{Name: "ops", Password: "secret", LockPasswd: &locked}, ptr(true)},
+		{"keys only", User{Name: "ops", SSHKeys: []string{"ssh-ed25519 AAAAone"}}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				ID:        101,
+				OS:        "debian",
+				Options:   Options{UUID: "test-uuid"},
+				CloudInit: CloudInit{Users: []User{tt.user}},
+			}
+			files, err := q.renderCloudInit(config)
+			if err != nil {
+				t.Fatalf("renderCloudInit failed: %v", err)
+			}
+			var userData cloudConfig
+			if err := yaml.Unmarshal([]byte(files["user-data"]), &userData); err != nil {
+				t.Fatalf("user-data is not valid YAML: %v", err)
+			}
+
+			got := userData.Users[0].LockPasswd
+			if (got == nil) != (tt.expect == nil) || (got != nil && *got != *tt.expect) {
+				t.Errorf("Expected lock_passwd %v, got %v", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestSha512Crypt(t *testing.T) {
+	// * vectors from the SHA-crypt specification
+	tests := []struct {
+		password string
+		salt     string
+		rounds   int
+		want     string
+	}{
+		{"Hello world!", "saltstring", 0, "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"Hello world!", "saltstringsaltstring", 10000, "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"we have a short salt string but not a short password", "short", 77777, "$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0"},
+	}
+	for _, tt := range tests {
+		if got := sha512Crypt(tt.password, tt.salt, tt.rounds); got != tt.want {
+			t.Errorf("sha512Crypt(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.rounds, got, tt.want)
+		}
+	}
+
+	hash, err := hashPassword("passwd")
+	if err != nil || !validHashedPasswd.MatchString(hash) || hash == sha512Crypt("passwd", "", 0) {
+		t.Errorf("Unexpected hash %q: %v", hash, err)
+	}
+	if other, _ := hashPassword("passwd"); other == hash {
+		t.Error("Expected a random salt per hash")
+	}
+}
+
+func TestVNCPassword(t *testing.T) {
+	var events []Event
+	q := &Qemu{
+		Folder: Folder{
+			Config:  t.TempDir(),
+			PID:     t.TempDir(),
+			Monitor: t.TempDir(),
+			State:   t.TempDir(),
+		},
+		Observer: ObserverFunc(func(e Event) { events = append(events, e) }),
+	}
+
+	uuid := "123e4567-e89b-12d3-a456-426614174000"
+	q.saveConfig(Config{
+		ID:       101,
+		Hostname: "debian-101.vm",
+		Memory:   2048,
+		CPUs:     2,
+		Disks:    []Disk{{Path: "/tmp/101-0.qcow2"}},
+		OS:       "debian",
+		Options:  Options{UUID: uuid},
+	})
+	pid := startFakeQemu(t, uuid)
+	os.WriteFile(filepath.Join(q.Folder.PID, "101.pid"), []byte(strconv.Itoa(pid)), 0644)
+	q.setState(101, StatusRunning, "process started", func(s *State) { s.PID = pid })
+
+	// * a leftover readable file is replaced, not rewritten in place
+	os.WriteFile(q.vncPasswordPath(101), []byte("old"), 0644)
+	if err := q.saveVNCPassword(101, "s3cretpw"); err != nil {
+		t.Fatalf("saveVNCPassword failed: %v", err)
+	}
+	if info, err := os.Stat(q.vncPasswordPath(101)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v, %v", info.Mode().Perm(), err)
+	}
+
+	address, err := q.VNCAddress(101)
+	if err != nil || !strings.HasPrefix(address, "vnc://:s3cretpw@") || !strings.HasSuffix(address, ":59101") {
+		t.Errorf("Unexpected VNC address: %s, %v", address, err)
+	}
+
+	if err := q.OpenVNC(101); err != nil {
+		t.Fatalf("OpenVNC failed: %v", err)
+	}
+	for _, e := range events {
+		if strings.Contains(e.Message, "s3cretpw") {
+			t.Errorf("Password leaked into event: %q", e.Message)
+		}
+	}
+
+	data, _ := q.storage().Get(KindState, "101")
+	if strings.Contains(string(data), "s3cretpw") {
+		t.Errorf("Password leaked into state: %s", data)
+	}
+}
+
+func TestSealPasswords(t *testing.T) {
+	q := &Qemu{Folder: Folder{Config: t.TempDir()}}
+
+	users := []User{{Name: "ops", Password: "user-secret"}}
+	config := Config{
+		ID:        101,
+		CloudInit: CloudInit{Password: "top-secret", Users: users},
+	}
+	if err := q.saveConfig(config); err != nil {
+		t.Fatalf("saveConfig failed: %v", err)
+	}
+	if users[0].Password != "user-secret" {
+		t.Error("saveConfig must not modify the caller's users")
+	}
+
+	data, _ := os.ReadFile(filepath.Join(q.Folder.Config, "101.json"))
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("Cleartext password saved: %s", data)
+	}
+	saved, err := q.readConfig(101)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if saved.CloudInit.PasswordHash != sha512Crypt("top-secret", saved.CloudInit.PasswordHash[3:19], 0) {
+		t.Errorf("Unexpected password hash: %s", saved.CloudInit.PasswordHash)
+	}
+	if !strings.HasPrefix(saved.CloudInit.Users[0].HashedPasswd, "$6$") {
+		t.Errorf("Unexpected user hash: %+v", saved.CloudInit.Users[0])
+	}
+
+	// * schema 2 configs are migrated, the backup keeps no cleartext either
+	os.WriteFile(filepath.Join(q.Folder.Config, "102.json"), []byte(`{"id": 102, "schema_version": 2, "cloud_init": {"username": "debian", "passwd": "old-secret"}}`), 0644)
+	migrated, err := q.readConfig(102)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if migrated.CloudInit.Password != "" || !strings.HasPrefix(migrated.CloudInit.PasswordHash, "$6$") {
+		t.Errorf("Expected hashed password after migration: %+v", migrated.CloudInit)
+	}
+	for _, name := range []string{"102.json", "102.v2.bak.json"} {
+		data, _ := os.ReadFile(filepath.Join(q.Folder.Config, name))
+		if strings.Contains(string(data), "old-secret") {
+			t.Errorf("Cleartext password left in %s: %s", name, data)
+		}
+	}
+
+	var configErr *ConfigError
+	config.CloudInit = CloudInit{Password: "a\nb"}
+	if err := q.saveConfig(config); !errors.As(err, &configErr) || configErr.Field != "cloud_init.passwd" {
+		t.Errorf("Expected ConfigError for a multi-line password, got %v", err)
+	}
+}
+
+func TestRenderCloudInit_Password(t *testing.T) {
+	q := &Qemu{}
+	disabled := false
+	config := Config{
+		ID:      101,
+		OS:      "debian",
+		Options: Options{UUID: "test-uuid"},
+		CloudInit: CloudInit{
+			PasswordHash:    "$6$salt$hash",
+			AuthorizedKey:   "ssh-ed25519 AAAAtest",
+			SSHPasswordAuth: &disabled,
+		},
+	}
+
+	files, err := q.renderCloudInit(config)
+	if err != nil {
+		t.Fatalf("renderCloudInit failed: %v", err)
+	}
+	var userData cloudConfig
+	yaml.Unmarshal([]byte(files["user-data"]), &userData)
+	user := userData.Users[0]
+	if userData.SSHPwauth || user.Passwd != "$6$salt$hash" || user.LockPasswd == nil || *user.LockPasswd {
+		t.Errorf("Unexpected user-data: %s", files["user-data"])
+	}
+
+	// * no password at all leaves the account locked, keys only
+	config.CloudInit.PasswordHash = ""
+	files, _ = q.renderCloudInit(config)
+	if strings.Contains(files["user-data"], "passwd") || strings.Contains(files["user-data"], "lock_passwd") {
+		t.Errorf("Expected no password in user-data: %s", files["user-data"])
+	}
+
+	config.CloudInit.PasswordHash = "plaintext"
+	var configErr *ConfigError
+	if _, err := q.renderCloudInit(config); !errors.As(err, &configErr) || configErr.Field != "cloud_init.passwd_hash" {
+		t.Errorf("Expected ConfigError for passwd_hash, got %v", err)
+	}
+}
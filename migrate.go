@@ -0,0 +1,163 @@
+package goQemu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// * bump together with a new entry in configMigrations
+const configSchema = 3
+
+// * configMigrations[n] upgrades schema n to n+1; they work on the raw JSON
+// * so an old file never has to fit the current Config struct
+var configMigrations = []func(raw map[string]any) error{
+	migrateNetworkStrings,
+	migrateDiskPath,
+	migrateHashPassword,
+}
+
+// * schema 0 stored networks as "bridge=vmbr0,model=...,mtu=1500" strings
+func migrateNetworkStrings(raw map[string]any) error {
+	values, _ := raw["network"].([]any)
+	networks := make([]any, 0, len(values))
+	for _, value := range values {
+		switch value := value.(type) {
+		case string:
+			networks = append(networks, ParseNetwork(value))
+		case map[string]any:
+			networks = append(networks, value)
+		default:
+			return fmt.Errorf("unexpected network entry: %v", value)
+		}
+	}
+	raw["network"] = networks
+	return nil
+}
+
+// * schema 1 had a single disk_path
+func migrateDiskPath(raw map[string]any) error {
+	path, _ := raw["disk_path"].(string)
+	delete(raw, "disk_path")
+	if _, ok := raw["disks"]; ok || path == "" {
+		return nil
+	}
+	raw["disks"] = []Disk{{Path: path, Format: "qcow2"}}
+	return nil
+}
+
+// * schema 2 kept the cloud-init password in cleartext
+func migrateHashPassword(raw map[string]any) error {
+	cloudInit, _ := raw["cloud_init"].(map[string]any)
+	password, _ := cloudInit["passwd"].(string)
+	if password == "" {
+		return nil
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	cloudInit["passwd_hash"] = hash
+	delete(cloudInit, "passwd")
+	return nil
+}
+
+// * upgraded data and the schema it was saved with
+func migrateConfig(data []byte) ([]byte, int, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, 0, err
+	}
+
+	version := 0
+	if value, ok := raw["schema_version"].(float64); ok {
+		version = int(value)
+	}
+
+	if version > configSchema {
+		return nil, version, fmt.Errorf("schema_version %d is newer than supported %d", version, configSchema)
+	}
+	if version == configSchema {
+		return data, version, nil
+	}
+
+	for n := version; n < configSchema; n++ {
+		if err := configMigrations[n](raw); err != nil {
+			return nil, version, fmt.Errorf("failed to migrate schema %d to %d: %w", n, n+1, err)
+		}
+	}
+	raw["schema_version"] = configSchema
+
+	upgraded, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return nil, version, err
+	}
+
+	return upgraded, version, nil
+}
+
+// * keep the config as it was before the first migration from this schema,
+// * the key is not a VMID so listings skip it; a cleartext password is left out
+func (q *Qemu) backupConfig(vmid, version int, data []byte) error {
+	key := fmt.Sprintf("%d.v%d.bak", vmid, version)
+	if _, err := q.storage().Get(KindConfig, key); err == nil {
+		return nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if cloudInit, ok := raw["cloud_init"].(map[string]any); ok {
+		if _, ok := cloudInit["passwd"]; ok {
+			delete(cloudInit, "passwd")
+			scrubbed, err := json.MarshalIndent(raw, "", "  ")
+			if err != nil {
+				return err
+			}
+			data = scrubbed
+		}
+	}
+
+	return q.storage().Put(KindConfig, key, data)
+}
+
+// * temp file in the same folder, synced, then renamed over the target;
+// * the leading dot keeps the temp file out of the VMID scan
+func writeFileAtomic(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmpPath := file.Name()
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package goQemu
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+const (
+	defaultVMIDStart = 100
+	defaultVMIDEnd   = 999
+)
+
+// * supported versions per OS
+var defaultCatalog = map[string][]string{
+	"debian":     {"11", "12", "13"},
+	"ubuntu":     {"20.04", "22.04", "24.04"},
+	"centos":     {"8", "9", "10"},
+	"rockylinux": {"8", "9", "10"},
+	"almalinux":  {"8", "9", "10"},
+}
+
+type Option func(q *Qemu) error
+
+// * base directory, defaults to ~/go-qemu
+func WithPath(path string) Option {
+	return func(q *Qemu) error {
+		if path == "" {
+			return fmt.Errorf("path must not be empty")
+		}
+		q.path = path
+		return nil
+	}
+}
+
+func WithVMIDRange(start, end int) Option {
+	return func(q *Qemu) error {
+		if start <= 0 || end < start {
+			return fmt.Errorf("invalid VMID range: %d-%d", start, end)
+		}
+		q.vmidStart = start
+		q.vmidEnd = end
+		return nil
+	}
+}
+
+// * qemu-system binary, defaults to qemu-system-<arch> from PATH
+func WithBinary(path string) Option {
+	return func(q *Qemu) error {
+		if path == "" {
+			return fmt.Errorf("binary must not be empty")
+		}
+		q.Binary = path
+		return nil
+	}
+}
+
+// * cloud-init password for VMs created without one, otherwise each gets a random one
+func WithDefaultPassword(password string) Option {
+	return func(q *Qemu) error {
+		if password == "" {
+			return fmt.Errorf("default password must not be empty")
+		}
+		q.password = password
+		return nil
+	}
+}
+
+// * replaces the supported versions of the given OSes, others keep the default
+func WithImageCatalog(catalog map[string][]string) Option {
+	return func(q *Qemu) error {
+		for osName, versions := range catalog {
+			if _, ok := defaultCatalog[osName]; !ok {
+				return fmt.Errorf("unsupported OS in catalog: %s", osName)
+			}
+			q.catalog[osName] = versions
+		}
+		return nil
+	}
+}
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(q *Qemu) error {
+		q.logger = logger
+		return nil
+	}
+}
+
+// * used for image downloads
+func WithHTTPClient(client *http.Client) Option {
+	return func(q *Qemu) error {
+		q.httpClient = client
+		return nil
+	}
+}
+
+// * leave disk, cloud-init ISO and config of a failed Create in place for debugging
+func WithKeepArtifacts(keep bool) Option {
+	return func(q *Qemu) error {
+		q.keepArtifacts = keep
+		return nil
+	}
+}
+
+// * where configs, state and tasks are kept, defaults to the directory layout
+func WithStore(store Store) Option {
+	return func(q *Qemu) error {
+		q.store = store
+		return nil
+	}
+}
+
+// * events are discarded unless set, e.g. NewConsoleObserver(os.Stderr) for the "[*] ..." output
+func WithObserver(observer Observer) Option {
+	return func(q *Qemu) error {
+		q.Observer = observer
+		return nil
+	}
+}
+
+// * GO_QEMU_* settings from .env files and the environment, the environment wins;
+// * without files ./.env is read if present. Options after it override it.
+func WithEnv(files ...string) Option {
+	return func(q *Qemu) error {
+		optional := len(files) == 0
+		if optional {
+			files = []string{".env"}
+		}
+
+		values := make(map[string]string)
+		for _, file := range files {
+			env, err := godotenv.Read(file)
+			if err != nil {
+				if optional && errors.Is(err, os.ErrNotExist) {
+					q.log().Info(".env not found, use system env")
+					continue
+				}
+				return fmt.Errorf("failed to read %s: %w", file, err)
+			}
+			maps.Copy(values, env)
+			if abs, err := filepath.Abs(file); err == nil {
+				q.envFiles = append(q.envFiles, abs)
+			}
+		}
+
+		lookup := func(key string) string {
+			if value, ok := os.LookupEnv(key); ok {
+				return value
+			}
+			return values[key]
+		}
+
+		if path := lookup("GO_QEMU_PATH"); path != "" {
+			q.path = path
+		}
+
+		switch store := lookup("GO_QEMU_STORE"); store {
+		case "":
+		case "dir", "bolt":
+			q.storeName = store
+		default:
+			return fmt.Errorf("invalid GO_QEMU_STORE: %s", store)
+		}
+
+		if seedURL := lookup("GO_QEMU_SEED_URL"); seedURL != "" {
+			if err := WithSeedURL(seedURL)(q); err != nil {
+				return err
+			}
+		}
+
+		if source := lookup("GO_QEMU_KEY_SOURCE"); source != "" {
+			if err := WithKeySource(source)(q); err != nil {
+				return err
+			}
+		}
+
+		if password := lookup("GO_QEMU_DEFAULT_PASSWORD"); password != "" {
+			q.password = password
+		}
+
+		start, end := q.vmidStart, q.vmidEnd
+		if value := lookup("GO_QEMU_VMID_START"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid GO_QEMU_VMID_START: %s", value)
+			}
+			start = n
+		}
+		if value := lookup("GO_QEMU_VMID_END"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid GO_QEMU_VMID_END: %s", value)
+			}
+			end = n
+		}
+		if err := WithVMIDRange(start, end)(q); err != nil {
+			return err
+		}
+
+		for osName := range defaultCatalog {
+			value := lookup("GO_QEMU_" + strings.ToUpper(osName) + "_VERSION")
+			if value == "" {
+				continue
+			}
+			var versions []string
+			for _, version := range strings.Split(value, ",") {
+				if version = strings.TrimSpace(version); version != "" {
+					versions = append(versions, version)
+				}
+			}
+			q.catalog[osName] = versions
+		}
+
+		return nil
+	}
+}
+
+func newQemu(opts ...Option) (*Qemu, error) {
+	q := &Qemu{
+		vmidStart: defaultVMIDStart,
+		vmidEnd:   defaultVMIDEnd,
+		catalog:   maps.Clone(defaultCatalog),
+	}
+
+	for _, opt := range opts {
+		if err := opt(q); err != nil {
+			return nil, err
+		}
+	}
+
+	if q.path == "" {
+		// * not assigned, use user home
+		usr, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user: %w", err)
+		}
+		if usr.HomeDir == "" {
+			return nil, fmt.Errorf("user home directory is empty")
+		}
+		q.path = filepath.Join(usr.HomeDir, "go-qemu")
+	}
+
+	return q, nil
+}
+
+// * fall back to defaults for a Qemu built without NewQemu
+func (q *Qemu) log() *slog.Logger {
+	if q.logger == nil {
+		return slog.Default()
+	}
+	return q.logger
+}
+
+func (q *Qemu) storage() Store {
+	if q.store == nil {
+		return NewDirStore(q.Folder)
+	}
+	return q.store
+}
+
+func (q *Qemu) client() *http.Client {
+	if q.httpClient == nil {
+		return httpClient
+	}
+	return q.httpClient
+}
+
+func (q *Qemu) vmidRange() (int, int) {
+	if q.vmidStart == 0 {
+		return defaultVMIDStart, defaultVMIDEnd
+	}
+	return q.vmidStart, q.vmidEnd
+}
+
+// * empty when a random password should be generated
+func (q *Qemu) vmPassword() string {
+	return q.password
+}
+
+func (q *Qemu) versions(osName string) []string {
+	if q.catalog == nil {
+		return defaultCatalog[osName]
+	}
+	return q.catalog[osName]
+}
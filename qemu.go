@@ -1,36 +1,29 @@
 package goQemu
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log/slog"
+	"io"
 	"os"
-	"os/user"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
-
-	"github.com/joho/godotenv"
+	"time"
 )
 
-func NewQemu() (*Qemu, error) {
-	err := godotenv.Load()
+// * settings come from opts only, use WithEnv to read GO_QEMU_* and .env
+func NewQemu(opts ...Option) (*Qemu, error) {
+	qemu, err := newQemu(opts...)
 	if err != nil {
-		slog.Info(".env not found, use system env")
+		return nil, err
 	}
 
-	mainPath := os.Getenv("GO_QEMU_PATH")
-	if mainPath == "" {
-		// * not assigned, use user home
-		usr, err := user.Current()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get user: %w", err)
-		}
-		if usr.HomeDir == "" {
-			return nil, fmt.Errorf("user home directory is empty")
-		}
-		mainPath = filepath.Join(usr.HomeDir, "go-qemu")
-	}
+	mainPath := qemu.path
 
 	if err := os.MkdirAll(mainPath, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create folder go-qemu: %w", err)
@@ -66,105 +59,275 @@ func NewQemu() (*Qemu, error) {
 		return nil, fmt.Errorf("failed to create folder go-qemu/images: %w", err)
 	}
 
-	var binary string
-	switch runtime.GOARCH {
-	case "amd64", "386":
-		binary = "qemu-system-x86_64"
-	case "arm64", "arm":
-		binary = "qemu-system-aarch64"
-	default:
-		return nil, fmt.Errorf("unsupported architecture: %s", runtime.GOARCH)
+	statesPath := filepath.Join(mainPath, "states")
+	if err := os.MkdirAll(statesPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create folder go-qemu/states: %w", err)
+	}
+
+	tasksPath := filepath.Join(mainPath, "tasks")
+	if err := os.MkdirAll(tasksPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create folder go-qemu/tasks: %w", err)
+	}
+
+	locksPath := filepath.Join(mainPath, "locks")
+	if err := os.MkdirAll(locksPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create folder go-qemu/locks: %w", err)
 	}
 
-	qemu := &Qemu{
-		Folder: Folder{
-			VM:      vmsPath,
-			Config:  configsPath,
-			Log:     logsPath,
-			PID:     pidsPath,
-			Monitor: monitorsPath,
-			Image:   imagesPath,
-		},
-		Binary: binary,
+	snapshotsPath := filepath.Join(mainPath, "snapshots")
+	if err := os.MkdirAll(snapshotsPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create folder go-qemu/snapshots: %w", err)
+	}
+
+	if qemu.Binary == "" {
+		binary, err := defaultBinary()
+		if err != nil {
+			return nil, err
+		}
+		qemu.Binary = binary
+	}
+
+	qemu.Folder = Folder{
+		VM:       vmsPath,
+		Config:   configsPath,
+		Log:      logsPath,
+		PID:      pidsPath,
+		Monitor:  monitorsPath,
+		Image:    imagesPath,
+		State:    statesPath,
+		Task:     tasksPath,
+		Lock:     locksPath,
+		Snapshot: snapshotsPath,
+	}
+
+	if qemu.store == nil && qemu.storeName == "bolt" {
+		store, err := NewBoltStore(filepath.Join(mainPath, "go-qemu.db"))
+		if err != nil {
+			return nil, err
+		}
+		qemu.store = store
+		qemu.ownStore = true
+	}
+
+	// * pick up VMs still running from a previous process or version
+	if report, err := qemu.Reconcile(); err != nil {
+		qemu.log().Warn("failed to reconcile running VMs", "error", err)
+	} else if len(report.Adopted) > 0 || len(report.Stale) > 0 || len(report.Orphans) > 0 {
+		qemu.log().Info("reconciled running VMs",
+			"adopted", report.Adopted,
+			"stale", report.Stale,
+			"orphans", len(report.Orphans),
+		)
 	}
 
 	return qemu, nil
 }
 
+// * releases the store NewQemu opened, a store passed through WithStore is left to the caller
+func (q *Qemu) Close() error {
+	if !q.ownStore {
+		return nil
+	}
+	if closer, ok := q.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func defaultBinary() (string, error) {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return "qemu-system-x86_64", nil
+	case "arm64", "arm":
+		return "qemu-system-aarch64", nil
+	default:
+		return "", fmt.Errorf("unsupported architecture: %s", runtime.GOARCH)
+	}
+}
+
 func (q *Qemu) saveConfig(config Config) error {
-	targetName := fmt.Sprintf("%d.json", config.ID)
-	targetPath := filepath.Join(q.Folder.Config, targetName)
+	// * Create and Update seal earlier, this keeps any other path from saving cleartext
+	if err := sealPasswords(&config.CloudInit); err != nil {
+		return err
+	}
+	config.SchemaVersion = configSchema
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(targetPath, data, 0644)
+	return q.storage().Put(KindConfig, strconv.Itoa(config.ID), data)
 }
 
-func (q *Qemu) loadConfig(vmid int) (*Config, error) {
-	targetName := fmt.Sprintf("%d.json", vmid)
-	targetPath := filepath.Join(q.Folder.Config, targetName)
-	data, err := os.ReadFile(targetPath)
+// * saved config with defaults applied, no artifacts are touched
+func (q *Qemu) loadConfig(ctx context.Context, vmid int) (*Config, error) {
+	config, err := q.readConfig(vmid)
 	if err != nil {
 		return nil, err
 	}
 
-	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
+	checked, err := q.checkConfig(*config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return checked, nil
+}
+
+// * raw saved config, without verify side effects; older schemas are upgraded in place
+func (q *Qemu) readConfig(vmid int) (*Config, error) {
+	key := strconv.Itoa(vmid)
+	data, err := q.storage().Get(KindConfig, key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("VM %d %w", vmid, ErrNotFound)
+		}
 		return nil, err
 	}
 
-	verifyConfig, err := q.verifyConfig(config)
+	upgraded, version, err := migrateConfig(data)
 	if err != nil {
-		return nil, fmt.Errorf("invalid config: %w", err)
+		return nil, configError("schema_version", "invalid config file for VM %d: %s", vmid, err)
+	}
+
+	if version != configSchema {
+		if err := q.backupConfig(vmid, version, data); err != nil {
+			return nil, fmt.Errorf("failed to back up config of VM %d: %w", vmid, err)
+		}
+		if err := q.storage().Put(KindConfig, key, upgraded); err != nil {
+			return nil, fmt.Errorf("failed to save migrated config of VM %d: %w", vmid, err)
+		}
+		q.infof(vmid, "migrated config of VM %d from schema %d to %d", vmid, version, configSchema)
 	}
 
-	return verifyConfig, nil
+	return decodeConfig(vmid, upgraded)
+}
+
+func decodeConfig(vmid int, data []byte) (*Config, error) {
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, configError("", "invalid config file for VM %d: %s", vmid, err)
+	}
+
+	return &config, nil
 }
 
 func (q *Qemu) deleteConfig(vmid int) error {
-	targetName := fmt.Sprintf("%d.json", vmid)
-	targetPath := filepath.Join(q.Folder.Config, targetName)
-	return os.Remove(targetPath)
+	return q.storage().Delete(KindConfig, strconv.Itoa(vmid))
 }
 
-func (q *Qemu) isRunning(pid int) bool {
-	process, err := os.FindProcess(pid)
+// * alive and verified to be the QEMU process of this VM, guards against PID reuse
+func (q *Qemu) isRunning(vmid, pid int) bool {
+	if !processAlive(pid) {
+		return false
+	}
+
+	args, err := processArgs(pid)
 	if err != nil {
+		q.log().Warn("failed to read process cmdline", "pid", pid, "error", err)
 		return false
 	}
 
-	err = process.Signal(syscall.Signal(0))
-	return err == nil
+	return q.isVMProcess(vmid, args)
 }
 
-func (q *Qemu) Cleanup() error {
-	ids, err := os.ReadDir(q.Folder.Config)
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	process, err := os.FindProcess(pid)
 	if err != nil {
-		return err
+		return false
 	}
 
-	cleaned := 0
-	for _, entry := range ids {
-		var vmid int
-		if _, err := fmt.Sscanf(entry.Name(), "%d.json", &vmid); err == nil {
-			if pidFilePath, pidData, err := q.getFile(q.Folder.PID, vmid); err == nil {
-				var pid int
-				fmt.Sscanf(pidData, "%d", &pid)
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+func (q *Qemu) isVMProcess(vmid int, args []string) bool {
+	if len(args) == 0 || !q.isQemuBinary(args[0]) {
+		return false
+	}
 
-				if !q.isRunning(pid) {
-					os.Remove(pidFilePath)
-					cleaned++
-				}
+	if config, err := q.readConfig(vmid); err == nil && config.Options.UUID != "" {
+		marker := "uuid=" + config.Options.UUID
+		for _, arg := range args {
+			if strings.Contains(arg, marker) {
+				return true
 			}
 		}
+		return false
+	}
+
+	// * no config to compare, fall back to the monitor socket
+	monitorPath := filepath.Join(q.Folder.Monitor, fmt.Sprintf("%d.sock", vmid))
+	for _, arg := range args {
+		if strings.Contains(arg, monitorPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// * qemu-system-* from PATH or the binary set through WithBinary, e.g. qemu-kvm
+func (q *Qemu) isQemuBinary(arg0 string) bool {
+	name := filepath.Base(arg0)
+	if strings.HasPrefix(name, "qemu-system") {
+		return true
+	}
+	return q.Binary != "" && name == filepath.Base(q.Binary)
+}
+
+func processArgs(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err == nil {
+		return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00"), nil
+	}
+
+	if _, statErr := os.Stat("/proc/self"); statErr == nil {
+		return nil, err
 	}
 
-	fmt.Printf("[*] cleaned up %d unused VM(s)\n", cleaned)
+	// * no procfs, ask ps
+	output, err := exec.Command("ps", "-ww", "-p", strconv.Itoa(pid), "-o", "command=").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(string(output)), nil
+}
+
+func (q *Qemu) Cleanup() error {
+	return q.CleanupContext(context.Background())
+}
+
+func (q *Qemu) CleanupContext(ctx context.Context) error {
+	report, err := q.ReconcileContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, orphan := range report.Orphans {
+		q.warn(orphan.VMID, fmt.Sprintf("orphaned QEMU process without config: PID %d", orphan.PID), nil)
+	}
+
+	q.infof(0, "cleaned up %d unused VM(s)", len(report.Stale))
 	return nil
 }
 
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 func (q *Qemu) getFile(folderPath string, vmid int) (string, string, error) {
 	var targetName string
 	switch folderPath {
@@ -172,8 +335,6 @@ func (q *Qemu) getFile(folderPath string, vmid int) (string, string, error) {
 		targetName = fmt.Sprintf("%d.pid", vmid)
 	case q.Folder.Monitor:
 		targetName = fmt.Sprintf("%d.sock", vmid)
-	case q.Folder.Config:
-		targetName = fmt.Sprintf("%d.json", vmid)
 	case q.Folder.Log:
 		targetName = fmt.Sprintf("%d.log", vmid)
 	default:
@@ -182,7 +343,7 @@ func (q *Qemu) getFile(folderPath string, vmid int) (string, string, error) {
 
 	targetPath := filepath.Join(folderPath, targetName)
 	if _, err := os.Stat(targetPath); os.IsNotExist(err) {
-		return targetPath, "", fmt.Errorf("file does not exist: %s/%s", targetPath, targetName)
+		return targetPath, "", fmt.Errorf("file %s %w", targetPath, ErrNotFound)
 	}
 
 	content, err := os.ReadFile(targetPath)
@@ -209,7 +370,7 @@ func (q *Qemu) diskPathAll(vmid int) ([]string, error) {
 	}
 
 	if len(matches) == 0 {
-		return nil, fmt.Errorf("no disk files found for VM %d", vmid)
+		return nil, fmt.Errorf("disk files for VM %d %w", vmid, ErrNotFound)
 	}
 
 	return matches, nil
@@ -0,0 +1,222 @@
+package goQemu
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+type qmpClient struct {
+	ctx    context.Context
+	conn   net.Conn
+	reader *bufio.Reader
+	stop   func() bool
+}
+
+const qmpTimeout = 5 * time.Second
+
+type qmpResponse struct {
+	Return json.RawMessage `json:"return"`
+	Event  string          `json:"event"`
+	Data   json.RawMessage `json:"data"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+type qmpStatus struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"`
+}
+
+func (q *Qemu) qmpPath(vmid int) string {
+	return filepath.Join(q.Folder.Monitor, fmt.Sprintf("%d.qmp", vmid))
+}
+
+func (q *Qemu) qgaPath(vmid int) string {
+	return filepath.Join(q.Folder.Monitor, fmt.Sprintf("%d.qga", vmid))
+}
+
+// * dedicated QMP socket for event listeners, QEMU serves one client per socket
+func (q *Qemu) eventPath(vmid int) string {
+	return filepath.Join(q.Folder.Monitor, fmt.Sprintf("%d.event", vmid))
+}
+
+func dialQMP(ctx context.Context, path string) (*qmpClient, error) {
+	client, err := dialMonitor(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to QMP: %w", err)
+	}
+
+	// * greeting: {"QMP": {...}}
+	client.setDeadline()
+	if _, err := client.reader.ReadBytes('\n'); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to read QMP greeting: %w", client.wrap(err))
+	}
+
+	if _, err := client.execute("qmp_capabilities", nil); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// * connection is closed as soon as ctx is done
+func dialMonitor(ctx context.Context, path string) (*qmpClient, error) {
+	dialer := net.Dialer{Timeout: 2 * time.Second}
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &qmpClient{
+		ctx:    ctx,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		stop:   context.AfterFunc(ctx, func() { conn.Close() }),
+	}, nil
+}
+
+// * per command deadline, bounded by ctx
+func (c *qmpClient) setDeadline() {
+	deadline := time.Now().Add(qmpTimeout)
+	if d, ok := c.ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+}
+
+func (c *qmpClient) wrap(err error) error {
+	if ctxErr := c.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+func (c *qmpClient) execute(command string, args any) (json.RawMessage, error) {
+	req := map[string]any{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.setDeadline()
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to send %s: %w", command, c.wrap(err))
+	}
+
+	for {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s response: %w", command, c.wrap(err))
+		}
+
+		var resp qmpResponse
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return nil, fmt.Errorf("invalid QMP response: %w", err)
+		}
+
+		// * skip async events
+		if resp.Event != "" {
+			continue
+		}
+
+		if resp.Error != nil {
+			return nil, fmt.Errorf("%s: %s (%s)", command, resp.Error.Desc, resp.Error.Class)
+		}
+
+		return resp.Return, nil
+	}
+}
+
+func (c *qmpClient) readEvent() (*qmpResponse, error) {
+	c.conn.SetDeadline(time.Time{})
+	for {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			return nil, c.wrap(err)
+		}
+
+		var resp qmpResponse
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return nil, fmt.Errorf("invalid QMP event: %w", err)
+		}
+
+		if resp.Event != "" {
+			return &resp, nil
+		}
+	}
+}
+
+func (c *qmpClient) Close() error {
+	c.stop()
+	return c.conn.Close()
+}
+
+func (q *Qemu) qmpExecute(ctx context.Context, vmid int, command string, args any) (json.RawMessage, error) {
+	client, err := dialQMP(ctx, q.qmpPath(vmid))
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return client.execute(command, args)
+}
+
+func (q *Qemu) queryStatus(ctx context.Context, vmid int) (*qmpStatus, error) {
+	data, err := q.qmpExecute(ctx, vmid, "query-status", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var status qmpStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("invalid query-status response: %w", err)
+	}
+
+	return &status, nil
+}
+
+// * guest agent speaks the same framing without greeting or capabilities
+func (q *Qemu) guestExecute(ctx context.Context, vmid int, command string, args any, wait bool) (json.RawMessage, error) {
+	client, err := dialMonitor(ctx, q.qgaPath(vmid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to guest agent: %w", err)
+	}
+	defer client.Close()
+
+	if _, err := client.execute("guest-ping", nil); err != nil {
+		return nil, fmt.Errorf("guest agent not responding: %w", err)
+	}
+
+	if wait {
+		return client.execute(command, args)
+	}
+
+	req := map[string]any{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// * guest-shutdown never replies on success
+	if _, err := client.conn.Write(append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to send %s: %w", command, err)
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,262 @@
+package goQemu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ReconcileReport struct {
+	Adopted []int           `json:"adopted"` // pid file rebuilt from a live process
+	Stale   []int           `json:"stale"`   // pid file or state without a live process
+	Orphans []OrphanProcess `json:"orphans"` // our QEMU processes without a config
+}
+
+type OrphanProcess struct {
+	PID  int    `json:"pid"`
+	VMID int    `json:"vmid,omitempty"`
+	UUID string `json:"uuid,omitempty"`
+}
+
+type qemuProcess struct {
+	pid     int
+	uuid    string
+	monitor string
+}
+
+// * match live QEMU processes to configs and rebuild pid files
+func (q *Qemu) Reconcile() (*ReconcileReport, error) {
+	return q.ReconcileContext(context.Background())
+}
+
+func (q *Qemu) ReconcileContext(ctx context.Context) (*ReconcileReport, error) {
+	processes, err := q.listQemuProcesses(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list QEMU processes: %w", err)
+	}
+
+	ids, err := q.configIDs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configs: %w", err)
+	}
+
+	configs := make(map[int]*Config, len(ids))
+	uuids := make(map[string]int, len(ids))
+	for _, vmid := range ids {
+		config, err := q.readConfig(vmid)
+		if err != nil {
+			continue
+		}
+		configs[vmid] = config
+		if config.Options.UUID != "" {
+			uuids[config.Options.UUID] = vmid
+		}
+	}
+
+	report := &ReconcileReport{}
+	matched := make(map[int]int, len(processes))
+	for _, proc := range processes {
+		vmid, ok := uuids[proc.uuid]
+		if !ok {
+			vmid, ok = q.monitorVMID(proc.monitor)
+			if !ok {
+				// * not started by this package
+				continue
+			}
+			if _, exists := configs[vmid]; !exists {
+				report.Orphans = append(report.Orphans, OrphanProcess{
+					PID:  proc.pid,
+					VMID: vmid,
+					UUID: proc.uuid,
+				})
+				continue
+			}
+		}
+		matched[vmid] = proc.pid
+	}
+
+	for vmid := range configs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if err := q.reconcileVM(ctx, vmid, matched, report); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Ints(report.Adopted)
+	sort.Ints(report.Stale)
+
+	return report, nil
+}
+
+// * under the VM lock, a Start between spawning QEMU and writing its pid file
+// * must not be marked crashed; a VM locked elsewhere is left for the next pass.
+// * VMs with nothing to fix are not locked, so other processes can operate on them
+func (q *Qemu) reconcileVM(ctx context.Context, vmid int, matched map[int]int, report *ReconcileReport) error {
+	if action, _ := q.reconcileAction(vmid, matched); action == "" {
+		return nil
+	}
+
+	ctx, unlock, err := q.lock(ctx, vmid, "reconcile")
+	if errors.Is(err, ErrLocked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pidFilePath := filepath.Join(q.Folder.PID, fmt.Sprintf("%d.pid", vmid))
+
+	// * checked again, the holder before us may have fixed it
+	action, pid := q.reconcileAction(vmid, matched)
+	switch action {
+	case "stale":
+		q.getState(ctx, vmid, 0)
+		os.Remove(pidFilePath)
+		report.Stale = append(report.Stale, vmid)
+
+	case "adopt":
+		if err := os.WriteFile(pidFilePath, []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("failed to save PID for VM %d: %w", vmid, err)
+		}
+
+		if state, err := q.loadState(vmid); err == nil && (state.Status == StatusRunning || state.Status == StatusPaused) {
+			q.updateState(vmid, func(s *State) {
+				s.PID = pid
+			})
+		} else {
+			q.setState(vmid, StatusRunning, "adopted running process", func(s *State) {
+				s.PID = pid
+			})
+		}
+		report.Adopted = append(report.Adopted, vmid)
+	}
+
+	return nil
+}
+
+// * "stale", "adopt" with the live pid, or empty when pid file and state agree with the process list
+func (q *Qemu) reconcileAction(vmid int, matched map[int]int) (string, int) {
+	var recorded int
+	if _, body, err := q.getFile(q.Folder.PID, vmid); err == nil {
+		fmt.Sscanf(body, "%d", &recorded)
+	}
+
+	pid, alive := matched[vmid]
+	if alive {
+		if recorded == pid {
+			return "", 0
+		}
+		return "adopt", pid
+	}
+
+	// * started after the process list was taken
+	if recorded != 0 && q.isRunning(vmid, recorded) {
+		return "", 0
+	}
+
+	state, _ := q.loadState(vmid)
+	claimed := state != nil && (state.Status == StatusRunning || state.Status == StatusPaused || state.Status == StatusStarting)
+	if recorded != 0 || claimed {
+		return "stale", 0
+	}
+	return "", 0
+}
+
+func (q *Qemu) monitorVMID(monitor string) (int, bool) {
+	if monitor == "" || filepath.Dir(monitor) != filepath.Clean(q.Folder.Monitor) {
+		return 0, false
+	}
+
+	var vmid int
+	if _, err := fmt.Sscanf(filepath.Base(monitor), "%d.sock", &vmid); err != nil {
+		return 0, false
+	}
+
+	return vmid, true
+}
+
+func (q *Qemu) listQemuProcesses(ctx context.Context) ([]qemuProcess, error) {
+	var list []qemuProcess
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		// * no procfs, ask ps
+		output, err := exec.CommandContext(ctx, "ps", "-ax", "-ww", "-o", "pid=,command=").Output()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			pid, err := strconv.Atoi(fields[0])
+			if err != nil {
+				continue
+			}
+			if proc, ok := q.parseQemuArgs(pid, fields[1:]); ok {
+				list = append(list, proc)
+			}
+		}
+
+		return list, nil
+	}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		args, err := processArgs(pid)
+		if err != nil {
+			continue
+		}
+
+		if proc, ok := q.parseQemuArgs(pid, args); ok {
+			list = append(list, proc)
+		}
+	}
+
+	return list, nil
+}
+
+func (q *Qemu) parseQemuArgs(pid int, args []string) (qemuProcess, bool) {
+	proc := qemuProcess{pid: pid}
+	if len(args) == 0 || !q.isQemuBinary(args[0]) {
+		return proc, false
+	}
+
+	for i := 1; i < len(args)-1; i++ {
+		switch args[i] {
+		case "-smbios":
+			for _, pair := range strings.Split(args[i+1], ",") {
+				if value, ok := strings.CutPrefix(pair, "uuid="); ok {
+					proc.uuid = value
+				}
+			}
+		case "-monitor":
+			value, ok := strings.CutPrefix(args[i+1], "unix:")
+			if ok {
+				proc.monitor = strings.Split(value, ",")[0]
+			}
+		}
+	}
+
+	return proc, true
+}
@@ -0,0 +1,146 @@
+package goQemu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// * NoCloud-Net seed: instead of the cidata CD-ROM the guest is told through the
+// * SMBIOS serial to fetch its files from <seed URL>/<uuid>/, rendered per request
+var seedFiles = map[string]bool{
+	"meta-data":      true,
+	"user-data":      true,
+	"vendor-data":    true,
+	"network-config": true,
+}
+
+// * base URL guests reach the seed server on, e.g. http://192.168.100.1:8686;
+// * set, VMs boot without the cloud-init ISO and ServeSeed must be running
+func WithSeedURL(seedURL string) Option {
+	return func(q *Qemu) error {
+		u, err := url.Parse(seedURL)
+		if err != nil {
+			return fmt.Errorf("invalid seed URL: %w", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid seed URL: %s", seedURL)
+		}
+		q.seedURL = strings.TrimSuffix(u.String(), "/")
+		return nil
+	}
+}
+
+// * empty when the ISO is used
+func (q *Qemu) SeedURL() string {
+	return q.seedURL
+}
+
+// * value of the SMBIOS type 1 serial, commas doubled for the QEMU option parser
+func (q *Qemu) seedSerial(config Config) string {
+	value := fmt.Sprintf("ds=nocloud-net;s=%s/%s/", q.seedURL, config.Options.UUID)
+	return strings.ReplaceAll(value, ",", ",,")
+}
+
+// * GET /<uuid>/<file>; the UUID is the only key, so a guest cannot guess its neighbours
+func (q *Qemu) SeedHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{uuid}/{file}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("file")
+		if !seedFiles[name] {
+			http.NotFound(w, r)
+			return
+		}
+
+		config, err := q.configByUUID(r.PathValue("uuid"))
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			q.warn(0, "failed to look up seed", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		files, err := q.renderCloudInit(*config)
+		if err != nil {
+			q.warn(config.ID, "failed to render cloud-init seed", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		data, ok := files[name]
+		if !ok && name != "vendor-data" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(data))
+	})
+	return mux
+}
+
+// * blocks until ctx is done; addr defaults to the host of the seed URL
+func (q *Qemu) ServeSeed(ctx context.Context, addr string) error {
+	if q.seedURL == "" {
+		return fmt.Errorf("seed URL is not set")
+	}
+	if addr == "" {
+		u, err := url.Parse(q.seedURL)
+		if err != nil {
+			return fmt.Errorf("invalid seed URL: %w", err)
+		}
+		addr = u.Host
+		if u.Port() == "" {
+			addr += ":" + u.Scheme
+		}
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           q.SeedHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve seed: %w", err)
+	}
+	return nil
+}
+
+func (q *Qemu) configByUUID(uuid string) (*Config, error) {
+	if uuid == "" {
+		return nil, fmt.Errorf("seed %w", ErrNotFound)
+	}
+
+	ids, err := q.configIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, vmid := range ids {
+		config, err := q.readConfig(vmid)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(config.Options.UUID, uuid) {
+			return config, nil
+		}
+	}
+
+	return nil, fmt.Errorf("seed %s %w", uuid, ErrNotFound)
+}
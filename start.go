@@ -1,53 +1,76 @@
 package goQemu
 
 import (
+	"context"
 	"fmt"
-	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
 	"syscall"
 	"time"
 )
 
 func (q *Qemu) Start(vmid int) error {
-	q.Cleanup()
+	return q.StartContext(context.Background(), vmid)
+}
+
+// * ctx bounds the preparation only, the QEMU process outlives it
+func (q *Qemu) StartContext(ctx context.Context, vmid int) error {
+	ctx, unlock, err := q.lock(ctx, vmid, "start")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := q.CleanupContext(ctx); err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
 
-	config, err := q.loadConfig(vmid)
+	config, err := q.loadConfig(ctx, vmid)
 	if err != nil {
 		return fmt.Errorf("failed to get vm-%d config: %w", vmid, err)
 	}
 
+	// * picks up cloud-init changes, or a deleted ISO, before boot
+	if changed, err := q.ensureCloudInit(ctx, config); err != nil {
+		return fmt.Errorf("failed to generate cloud-init: %w", err)
+	} else if changed {
+		if err := q.saveConfig(*config); err != nil {
+			return fmt.Errorf("failed to save config: %w", err)
+		}
+	}
+
 	if pidFilepath, pidContent, err := q.getFile(q.Folder.PID, vmid); err == nil {
 		var pid int
 		fmt.Sscanf(pidContent, "%d", &pid)
 
-		if q.isRunning(pid) {
-			return fmt.Errorf("VM %d is already running: PID %d", vmid, pid)
+		if q.isRunning(vmid, pid) {
+			return fmt.Errorf("VM %d is %w: PID %d", vmid, ErrAlreadyRunning, pid)
 		}
 		os.Remove(pidFilepath)
 	}
 
-	if _, err := os.Stat(config.DiskPath); err != nil {
-		return fmt.Errorf("disk not found: %s", config.DiskPath)
+	for _, disk := range config.Disks {
+		if _, err := os.Stat(disk.Path); err != nil {
+			return fmt.Errorf("disk %s %w", disk.Path, ErrNotFound)
+		}
 	}
 
 	// if _, err := os.Stat(config.BIOS); err != nil {
 	// 	return fmt.Errorf("BIOS not found: %s", config.BIOS)
 	// }
 
-	pid, err := q.runVM(config, vmid)
+	pid, err := q.runVM(ctx, config, vmid)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("VM %d started with PID %d\n", vmid, pid)
+	q.infof(vmid, "VM %d started with PID %d", vmid, pid)
 	return nil
 }
 
-func (q *Qemu) checkHVFSlots() error {
-	cmd := exec.Command("pgrep", "-c", "qemu-system-aarch64")
+func (q *Qemu) checkHVFSlots(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "pgrep", "-c", "qemu-system-aarch64")
 	output, _ := cmd.Output()
 
 	count := 0
@@ -60,9 +83,13 @@ func (q *Qemu) checkHVFSlots() error {
 	return nil
 }
 
-func (q *Qemu) runVM(config *Config, vmid int) (int, error) {
-	if err := q.checkHVFSlots(); err != nil {
-		return 0, fmt.Errorf("HVF resource issue: %w\nTry: ./qmac cleanup", err)
+func (q *Qemu) runVM(ctx context.Context, config *Config, vmid int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := q.checkHVFSlots(ctx); err != nil {
+		return 0, fmt.Errorf("HVF resource issue: %w\nTry: go-qemu cleanup", err)
 	}
 
 	logFile := fmt.Sprintf("%d.log", vmid)
@@ -73,14 +100,11 @@ func (q *Qemu) runVM(config *Config, vmid int) (int, error) {
 	}
 	defer logOut.Close()
 
-	var binary string
-	switch runtime.GOARCH {
-	case "amd64", "386":
-		binary = "qemu-system-x86_64"
-	case "arm64", "arm":
-		binary = "qemu-system-aarch64"
-	default:
-		return 0, fmt.Errorf("unsupported architecture: %s", runtime.GOARCH)
+	binary := q.Binary
+	if binary == "" {
+		if binary, err = defaultBinary(); err != nil {
+			return 0, err
+		}
 	}
 
 	args := q.verifyArgs(*config)
@@ -93,7 +117,12 @@ func (q *Qemu) runVM(config *Config, vmid int) (int, error) {
 		Setpgid: true,
 	}
 
+	q.setState(vmid, StatusStarting, "start requested", nil)
+
 	if err := cmd.Start(); err != nil {
+		q.setState(vmid, StatusCrashed, "failed to start", func(s *State) {
+			s.ExitReason = err.Error()
+		})
 		return 0, fmt.Errorf("failed to start VM: %w", err)
 	}
 
@@ -101,19 +130,41 @@ func (q *Qemu) runVM(config *Config, vmid int) (int, error) {
 	pidFile := fmt.Sprintf("%d.pid", vmid)
 	pidFilePath := filepath.Join(q.Folder.PID, pidFile)
 	if err := os.WriteFile(pidFilePath, []byte(fmt.Sprintf("%d", pid)), 0644); err != nil {
+		// * untracked process, do not leave it behind
+		cmd.Process.Kill()
+		cmd.Wait()
+		q.setState(vmid, StatusCrashed, "failed to save PID", nil)
 		return 0, fmt.Errorf("failed to save PID: %w", err)
 	}
 
-	time.Sleep(1 * time.Second)
-	if err := q.setVNCPassword(vmid, config.CloudInit.Password); err != nil {
-		slog.Warn("failed to set VNC password", "error", err)
+	// * the login password is only kept as a hash, VNC gets its own per start
+	vncPassword, err := randomString(passwordAlphabet, vncPasswordLength)
+	if err == nil {
+		err = q.saveVNCPassword(vmid, vncPassword)
+	}
+	if err != nil {
+		q.warn(vmid, "VNC password not set", err)
+		vncPassword = ""
 	}
 
+	q.setState(vmid, StatusRunning, "process started", func(s *State) {
+		s.PID = pid
+	})
+
 	go func() {
-		cmd.Wait()
+		q.recordExit(vmid, pid, cmd.Wait())
 	}()
 
-	fmt.Printf("log file: %s\n", logFilePath)
+	// * without a password VNC keeps refusing connections
+	if vncPassword != "" {
+		if err := sleepContext(ctx, 1*time.Second); err != nil {
+			q.warn(vmid, "VNC password not set", err)
+		} else if err := q.setVNCPassword(ctx, vmid, vncPassword); err != nil {
+			q.warn(vmid, "failed to set VNC password", err)
+		}
+	}
+
+	q.infof(vmid, "log file: %s", logFilePath)
 
 	return pid, nil
 }
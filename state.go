@@ -0,0 +1,309 @@
+package goQemu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	StatusCreating     = "creating"
+	StatusStarting     = "starting"
+	StatusRunning      = "running"
+	StatusPaused       = "paused"
+	StatusShuttingDown = "shutting-down"
+	StatusStopped      = "stopped"
+	StatusCrashed      = "crashed"
+)
+
+const (
+	maxTransitions = 32
+	logTailLines   = 20
+)
+
+// * errors.Is(err, ErrNotFound) when the VM has no recorded state
+func (q *Qemu) loadState(vmid int) (*State, error) {
+	data, err := q.storage().Get(KindState, strconv.Itoa(vmid))
+	if err != nil {
+		return nil, err
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid state file: %w", err)
+	}
+
+	return &state, nil
+}
+
+func (q *Qemu) saveState(vmid int, state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return q.storage().Put(KindState, strconv.Itoa(vmid), data)
+}
+
+// * update fields without recording a transition
+func (q *Qemu) updateState(vmid int, update func(*State)) error {
+	q.stateMu.Lock()
+	defer q.stateMu.Unlock()
+
+	state, err := q.loadState(vmid)
+	if err != nil {
+		return err
+	}
+
+	update(state)
+	state.UpdatedAt = time.Now()
+
+	return q.saveState(vmid, state)
+}
+
+func (q *Qemu) deleteState(vmid int) error {
+	return q.storage().Delete(KindState, strconv.Itoa(vmid))
+}
+
+// * record a lifecycle transition, update is applied before saving
+func (q *Qemu) setState(vmid int, status, reason string, update func(*State)) (*State, error) {
+	return q.setStateIf(vmid, func(*State) (string, string, bool) {
+		return status, reason, true
+	}, update)
+}
+
+// * decide sees the current state under stateMu and picks the transition,
+// * ok false leaves the state untouched and returns nil
+func (q *Qemu) setStateIf(vmid int, decide func(*State) (status, reason string, ok bool), update func(*State)) (*State, error) {
+	state, err := q.transition(vmid, decide, update)
+	if err != nil || state == nil {
+		return nil, err
+	}
+
+	// * outside stateMu so an observer may query the VM
+	last := state.History[len(state.History)-1]
+	q.emit(Event{
+		Type:    EventLifecycle,
+		VMID:    vmid,
+		Message: last.Reason,
+		From:    last.From,
+		To:      last.To,
+	})
+	return state, nil
+}
+
+func (q *Qemu) transition(vmid int, decide func(*State) (string, string, bool), update func(*State)) (*State, error) {
+	q.stateMu.Lock()
+	defer q.stateMu.Unlock()
+
+	now := time.Now()
+	state, err := q.loadState(vmid)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		state = &State{
+			Status:    StatusStopped,
+			CreatedAt: now,
+		}
+	}
+
+	status, reason, ok := decide(state)
+	if !ok {
+		return nil, nil
+	}
+
+	state.History = append(state.History, Transition{
+		From:   state.Status,
+		To:     status,
+		Reason: reason,
+		At:     now,
+	})
+	if len(state.History) > maxTransitions {
+		state.History = state.History[len(state.History)-maxTransitions:]
+	}
+
+	state.Status = status
+	state.UpdatedAt = now
+
+	switch status {
+	case StatusStarting:
+		state.ExitCode = nil
+		state.ExitReason = ""
+		state.LogTail = ""
+		state.Shutdown = ""
+		state.StoppedAt = nil
+		state.Pending = nil
+	case StatusRunning:
+		if state.StartedAt == nil || state.History[len(state.History)-1].From == StatusStarting {
+			state.StartedAt = &now
+		}
+	case StatusStopped, StatusCrashed:
+		state.PID = 0
+		state.StoppedAt = &now
+		if state.ExitReason == "" {
+			state.ExitReason = reason
+		}
+	}
+
+	if update != nil {
+		update(state)
+	}
+
+	if err := q.saveState(vmid, state); err != nil {
+		return nil, fmt.Errorf("failed to save state: %w", err)
+	}
+
+	return state, nil
+}
+
+// * called once QEMU exits while this process is still watching it
+func (q *Qemu) recordExit(vmid, pid int, waitErr error) {
+	code := 0
+	reason := "guest poweroff"
+	var exitErr *exec.ExitError
+	if errors.As(waitErr, &exitErr) {
+		code = exitErr.ExitCode()
+		reason = exitErr.Error()
+	} else if waitErr != nil {
+		code = -1
+		reason = waitErr.Error()
+	}
+
+	// * checked and written under one stateMu hold, a concurrent Stop must not
+	// * have its stopped overwritten by crashed or the other way round
+	tail := ""
+	q.setStateIf(vmid, func(state *State) (string, string, bool) {
+		// * already handled by Stop or belongs to a newer start
+		if state.PID != pid || state.Status == StatusStopped || state.Status == StatusCrashed {
+			return "", "", false
+		}
+
+		status := StatusStopped
+		if state.Status == StatusShuttingDown {
+			reason = "shutdown requested"
+			if state.Shutdown != "" {
+				reason = "shutdown by " + state.Shutdown
+			}
+		} else if code != 0 {
+			status = StatusCrashed
+			tail = q.logTail(vmid)
+		}
+		return status, reason, true
+	}, func(s *State) {
+		s.ExitCode = &code
+		s.ExitReason = reason
+		s.LogTail = tail
+	})
+}
+
+// * reconcile persisted state against the process table
+func (q *Qemu) getState(ctx context.Context, vmid, pid int) *State {
+	state, err := q.loadState(vmid)
+	if err != nil {
+		state = &State{Status: StatusStopped}
+		if errors.Is(err, ErrNotFound) && pid > 0 && q.isRunning(vmid, pid) {
+			state.Status = StatusRunning
+		} else {
+			return state
+		}
+	}
+
+	state.PID = pid
+	if pid == 0 || !q.isRunning(vmid, pid) {
+		state.PID = 0
+		// * a Start holding the lock elsewhere has not written the pid file yet;
+		// * the holder itself, e.g. reconcile, goes on and settles the state
+		if state.Status == StatusStarting && pid == 0 {
+			if held, _ := ctx.Value(lockKey{vmid}).(bool); !held && q.LockHolder(vmid) != nil {
+				return state
+			}
+		}
+		switch state.Status {
+		case StatusStarting, StatusRunning, StatusPaused:
+			tail := q.logTail(vmid)
+			if updated, err := q.setState(vmid, StatusCrashed, "process exited unexpectedly", func(s *State) {
+				s.LogTail = tail
+			}); err == nil {
+				return updated
+			}
+			state.Status = StatusCrashed
+		case StatusShuttingDown:
+			reason := "shutdown requested"
+			if state.Shutdown != "" {
+				reason = "shutdown by " + state.Shutdown
+			}
+			if updated, err := q.setState(vmid, StatusStopped, reason, nil); err == nil {
+				return updated
+			}
+			state.Status = StatusStopped
+		}
+		return state
+	}
+
+	switch state.Status {
+	case StatusStarting, StatusShuttingDown:
+		return state
+	}
+
+	status, err := q.queryStatus(ctx, vmid)
+	if err != nil {
+		// * monitor unreachable, trust the process
+		return state
+	}
+
+	current := StatusRunning
+	if status.Status == "paused" {
+		current = StatusPaused
+	}
+
+	if current != state.Status {
+		if updated, err := q.setState(vmid, current, "status query", nil); err == nil {
+			updated.PID = pid
+			return updated
+		}
+		state.Status = current
+	}
+
+	return state
+}
+
+func (q *Qemu) logTail(vmid int) string {
+	logPath := filepath.Join(q.Folder.Log, fmt.Sprintf("%d.log", vmid))
+	file, err := os.Open(logPath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return ""
+	}
+
+	size := int64(4096)
+	offset := info.Size() - size
+	if offset < 0 {
+		offset = 0
+		size = info.Size()
+	}
+
+	buf := make([]byte, size)
+	if _, err := file.ReadAt(buf, offset); err != nil {
+		return ""
+	}
+
+	lines := strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+	if len(lines) > logTailLines {
+		lines = lines[len(lines)-logTailLines:]
+	}
+
+	return strings.Join(lines, "\n")
+}
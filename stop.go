@@ -1,14 +1,25 @@
 package goQemu
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"syscall"
+	"time"
 )
 
 func (q *Qemu) Stop(vmid int) error {
-	_, err := q.loadConfig(vmid)
+	return q.StopContext(context.Background(), vmid)
+}
+
+func (q *Qemu) StopContext(ctx context.Context, vmid int) error {
+	ctx, unlock, err := q.lock(ctx, vmid, "stop")
 	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := q.loadConfig(ctx, vmid); err != nil {
 		return fmt.Errorf("failed to get VM %d config: %w", vmid, err)
 	}
 
@@ -17,8 +28,8 @@ func (q *Qemu) Stop(vmid int) error {
 	if err == nil {
 		fmt.Sscanf(pidBody, "%d", &pid)
 	}
-	if !q.isRunning(pid) {
-		return fmt.Errorf("VM %d is not running", vmid)
+	if !q.isRunning(vmid, pid) {
+		return fmt.Errorf("VM %d is %w", vmid, ErrNotRunning)
 	}
 
 	process, err := os.FindProcess(pid)
@@ -26,13 +37,102 @@ func (q *Qemu) Stop(vmid int) error {
 		return fmt.Errorf("failed to find process: %w", err)
 	}
 
+	q.setState(vmid, StatusShuttingDown, "stop requested", func(s *State) {
+		s.Shutdown = "user"
+	})
+
 	if err := process.Signal(syscall.SIGTERM); err != nil {
 		return fmt.Errorf("failed to stop VM: %w", err)
 	}
 
+	if !q.waitExit(ctx, vmid, pid, stopTimeout) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		q.warn(vmid, "VM did not exit on SIGTERM, killing", nil)
+		if err := process.Signal(syscall.SIGKILL); err != nil {
+			return fmt.Errorf("failed to kill VM: %w", err)
+		}
+		// * still alive, keep the pid file so the VM stays tracked
+		if !q.waitExit(ctx, vmid, pid, 5*time.Second) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("VM %d did not exit after SIGKILL: PID %d", vmid, pid)
+		}
+	}
+	q.getState(ctx, vmid, pid)
+
 	os.Remove(pidFilepath)
 
-	q.Cleanup()
+	q.CleanupContext(ctx)
+
+	return nil
+}
+
+// * SIGTERM grace period before Stop kills the process
+var stopTimeout = 10 * time.Second
+
+// * false when the process is still running after timeout or ctx is done
+func (q *Qemu) waitExit(ctx context.Context, vmid, pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for q.isRunning(vmid, pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		if err := sleepContext(ctx, 250*time.Millisecond); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// * ask the guest to power off, fall back to Stop after timeout
+func (q *Qemu) Shutdown(vmid int, timeout time.Duration) error {
+	return q.ShutdownContext(context.Background(), vmid, timeout)
+}
+
+func (q *Qemu) ShutdownContext(ctx context.Context, vmid int, timeout time.Duration) error {
+	ctx, unlock, err := q.lock(ctx, vmid, "shutdown")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var pid int
+	if _, pidBody, err := q.getFile(q.Folder.PID, vmid); err == nil {
+		fmt.Sscanf(pidBody, "%d", &pid)
+	}
+	if pid == 0 || !q.isRunning(vmid, pid) {
+		return fmt.Errorf("VM %d is %w", vmid, ErrNotRunning)
+	}
+
+	q.setState(vmid, StatusShuttingDown, "shutdown requested", func(s *State) {
+		s.Shutdown = "user"
+	})
+
+	if _, err := q.guestExecute(ctx, vmid, "guest-shutdown", map[string]any{"mode": "powerdown"}, false); err != nil {
+		if _, err := q.qmpExecute(ctx, vmid, "system_powerdown", nil); err != nil {
+			q.warn(vmid, "failed to request ACPI shutdown", err)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) && q.isRunning(vmid, pid) {
+		if err := sleepContext(ctx, 500*time.Millisecond); err != nil {
+			return err
+		}
+	}
+
+	if q.isRunning(vmid, pid) {
+		q.warn(vmid, fmt.Sprintf("graceful shutdown timed out after %s, stopping", timeout), nil)
+		return q.StopContext(ctx, vmid)
+	}
+
+	q.getState(ctx, vmid, pid)
+	if pidFilepath, _, err := q.getFile(q.Folder.PID, vmid); err == nil {
+		os.Remove(pidFilepath)
+	}
 
 	return nil
 }
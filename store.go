@@ -0,0 +1,286 @@
+package goQemu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type Kind string
+
+const (
+	KindConfig   Kind = "configs"
+	KindState    Kind = "states"
+	KindTask     Kind = "tasks"
+	KindSnapshot Kind = "snapshots"
+)
+
+// * JSON documents by kind and key, e.g. (KindConfig, "101");
+// * Get wraps ErrNotFound, Put replaces atomically, Delete ignores missing keys.
+// * Pid files stay in Folder.PID beside the monitor sockets and lock files: they
+// * describe processes on this host, Reconcile rebuilds them from the process
+// * table, and a store copied to another host must not claim its VMs are running
+type Store interface {
+	Get(kind Kind, key string) ([]byte, error)
+	Put(kind Kind, key string, data []byte) error
+	Delete(kind Kind, key string) error
+	Keys(kind Kind) ([]string, error)
+}
+
+// * one <key>.json per document in the folder of its kind
+type dirStore struct {
+	folders map[Kind]string
+}
+
+func NewDirStore(folder Folder) Store {
+	return &dirStore{
+		folders: map[Kind]string{
+			KindConfig:   folder.Config,
+			KindState:    folder.State,
+			KindTask:     folder.Task,
+			KindSnapshot: folder.Snapshot,
+		},
+	}
+}
+
+func (s *dirStore) path(kind Kind, key string) (string, error) {
+	folder, ok := s.folders[kind]
+	if !ok {
+		return "", fmt.Errorf("unsupported store kind: %s", kind)
+	}
+	if key == "" || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid store key: %q", key)
+	}
+	return filepath.Join(folder, key+".json"), nil
+}
+
+func (s *dirStore) Get(kind Kind, key string) ([]byte, error) {
+	path, err := s.path(kind, key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s/%s %w", kind, key, ErrNotFound)
+	}
+	return data, err
+}
+
+func (s *dirStore) Put(kind Kind, key string, data []byte) error {
+	path, err := s.path(kind, key)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func (s *dirStore) Delete(kind Kind, key string) error {
+	path, err := s.path(kind, key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *dirStore) Keys(kind Kind) ([]string, error) {
+	folder, ok := s.folders[kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported store kind: %s", kind)
+	}
+
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", folder, err)
+	}
+
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		// * dot files are in-flight writes
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if key, ok := strings.CutSuffix(entry.Name(), ".json"); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// * one bucket per kind in a single bbolt file; bbolt locks the whole file while
+// * it is open, so it is opened per operation and other processes wait at most
+// * boltTimeout for a single transaction, never for a long-lived handle
+type boltStore struct {
+	path string
+	mu   *sync.RWMutex // * shared by stores on the same path, a second open in-process would wait on the flock
+}
+
+const boltTimeout = 5 * time.Second
+
+var (
+	boltMu    sync.Mutex
+	boltLocks = make(map[string]*sync.RWMutex)
+)
+
+func NewBoltStore(path string) (Store, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	boltMu.Lock()
+	mu, ok := boltLocks[abs]
+	if !ok {
+		mu = &sync.RWMutex{}
+		boltLocks[abs] = mu
+	}
+	boltMu.Unlock()
+
+	store := &boltStore{path: abs, mu: mu}
+
+	// * create the buckets up front, surfaces a bad file early
+	err = store.update(func(tx *bolt.Tx) error {
+		for _, kind := range []Kind{KindConfig, KindState, KindTask, KindSnapshot} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(kind)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// * read-only opens take a shared lock, readers in several processes do not wait on each other
+func (s *boltStore) open(readOnly bool, fn func(db *bolt.DB) error) error {
+	if readOnly {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	} else {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: boltTimeout, ReadOnly: readOnly})
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", s.path, err)
+	}
+	defer db.Close()
+
+	return fn(db)
+}
+
+func (s *boltStore) view(fn func(tx *bolt.Tx) error) error {
+	return s.open(true, func(db *bolt.DB) error {
+		return db.View(fn)
+	})
+}
+
+func (s *boltStore) update(fn func(tx *bolt.Tx) error) error {
+	return s.open(false, func(db *bolt.DB) error {
+		return db.Update(fn)
+	})
+}
+
+func bucket(tx *bolt.Tx, kind Kind) (*bolt.Bucket, error) {
+	b := tx.Bucket([]byte(kind))
+	if b == nil {
+		return nil, fmt.Errorf("unsupported store kind: %s", kind)
+	}
+	return b, nil
+}
+
+func (s *boltStore) Get(kind Kind, key string) ([]byte, error) {
+	var data []byte
+	err := s.view(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, kind)
+		if err != nil {
+			return err
+		}
+		value := b.Get([]byte(key))
+		if value == nil {
+			return fmt.Errorf("%s/%s %w", kind, key, ErrNotFound)
+		}
+		// * only valid inside the transaction
+		data = append([]byte(nil), value...)
+		return nil
+	})
+	return data, err
+}
+
+func (s *boltStore) Put(kind Kind, key string, data []byte) error {
+	if key == "" {
+		return fmt.Errorf("invalid store key: %q", key)
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, kind)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+func (s *boltStore) Delete(kind Kind, key string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, kind)
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (s *boltStore) Keys(kind Kind) ([]string, error) {
+	var keys []string
+	err := s.view(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, kind)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// * VMIDs of the saved configs, ascending; backups and prior configs are skipped
+func (q *Qemu) configIDs() ([]int, error) {
+	keys, err := q.storage().Keys(KindConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(keys))
+	for _, key := range keys {
+		vmid, err := strconv.Atoi(key)
+		if err != nil || vmid <= 0 {
+			continue
+		}
+		ids = append(ids, vmid)
+	}
+	sort.Ints(ids)
+
+	return ids, nil
+}
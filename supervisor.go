@@ -0,0 +1,246 @@
+package goQemu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+const (
+	defaultRestartBackoff = 5 * time.Second
+	maxRestartBackoff     = 5 * time.Minute
+	// * restart counter is cleared once a VM stays up this long
+	restartResetAfter = 10 * time.Minute
+)
+
+type Supervisor struct {
+	qemu     *Qemu
+	interval time.Duration
+	mu       sync.Mutex
+	watching map[int]int // vmid -> pid
+}
+
+func (q *Qemu) NewSupervisor(interval time.Duration) *Supervisor {
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+
+	return &Supervisor{
+		qemu:     q,
+		interval: interval,
+		watching: make(map[int]int),
+	}
+}
+
+// * blocks until ctx is cancelled
+func (s *Supervisor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Supervisor) check(ctx context.Context) {
+	q := s.qemu
+	ids, err := q.configIDs()
+	if err != nil {
+		s.qemu.log().Error("supervisor failed to read configs", "error", err)
+		return
+	}
+
+	for _, vmid := range ids {
+		config, err := q.readConfig(vmid)
+		if err != nil {
+			continue
+		}
+
+		var pid int
+		if _, pidData, err := q.getFile(q.Folder.PID, vmid); err == nil {
+			fmt.Sscanf(pidData, "%d", &pid)
+		}
+
+		state := q.getState(ctx, vmid, pid)
+		switch state.Status {
+		case StatusRunning, StatusPaused:
+			s.watch(ctx, vmid, pid)
+			if state.Restarts > 0 && state.StartedAt != nil && time.Since(*state.StartedAt) > restartResetAfter {
+				q.updateState(vmid, func(st *State) {
+					st.Restarts = 0
+				})
+			}
+		case StatusStopped, StatusCrashed:
+			// * an operation owns the VM, look again next tick
+			if q.LockHolder(vmid) != nil {
+				continue
+			}
+			s.restart(ctx, config, state)
+		}
+	}
+}
+
+func (s *Supervisor) watch(ctx context.Context, vmid, pid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.watching[vmid] == pid {
+		return
+	}
+
+	client, err := dialQMP(ctx, s.qemu.eventPath(vmid))
+	if err != nil {
+		s.qemu.log().Warn("supervisor failed to listen for events", "vmid", vmid, "error", err)
+		return
+	}
+	s.watching[vmid] = pid
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-done:
+		}
+	}()
+
+	go func() {
+		defer close(done)
+		defer client.Close()
+		defer func() {
+			s.mu.Lock()
+			if s.watching[vmid] == pid {
+				delete(s.watching, vmid)
+			}
+			s.mu.Unlock()
+		}()
+
+		for {
+			event, err := client.readEvent()
+			if err != nil {
+				break
+			}
+
+			if event.Event == "SHUTDOWN" {
+				s.handleShutdown(vmid, event.Data)
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		// * monitor closed, give QEMU a moment to exit before reconciling
+		for i := 0; i < 10 && s.qemu.isRunning(vmid, pid); i++ {
+			if sleepContext(ctx, 500*time.Millisecond) != nil {
+				return
+			}
+		}
+		s.qemu.getState(ctx, vmid, pid)
+	}()
+}
+
+func (s *Supervisor) handleShutdown(vmid int, data json.RawMessage) {
+	var event struct {
+		Guest  bool   `json:"guest"`
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(data, &event)
+
+	state, err := s.qemu.loadState(vmid)
+	if err != nil {
+		return
+	}
+
+	// * stop requested through the package
+	if state.Status == StatusShuttingDown && state.Shutdown == "user" {
+		return
+	}
+
+	initiator := "host"
+	if event.Guest {
+		initiator = "guest"
+	}
+
+	s.qemu.log().Info("VM shutdown event", "vmid", vmid, "initiator", initiator, "reason", event.Reason)
+	s.qemu.setState(vmid, StatusShuttingDown, fmt.Sprintf("%s %s", initiator, event.Reason), func(st *State) {
+		st.Shutdown = initiator
+	})
+}
+
+func (s *Supervisor) restart(ctx context.Context, config *Config, state *State) {
+	vmid := config.ID
+	if !shouldRestart(config.Restart, state) {
+		return
+	}
+
+	backoff := defaultRestartBackoff
+	if config.Restart.Backoff > 0 {
+		backoff = time.Duration(config.Restart.Backoff) * time.Second
+	}
+	for i := 0; i < state.Restarts && backoff < maxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRestartBackoff {
+		backoff = maxRestartBackoff
+	}
+
+	if state.StoppedAt != nil && time.Since(*state.StoppedAt) < backoff {
+		return
+	}
+
+	attempt := state.Restarts + 1
+	s.qemu.log().Info("restarting VM",
+		"vmid", vmid,
+		"policy", config.Restart.Policy,
+		"attempt", attempt,
+		"previous", state.Status,
+		"reason", state.ExitReason,
+	)
+
+	// * count before starting so a failed start still backs off
+	s.qemu.updateState(vmid, func(st *State) {
+		st.Restarts = attempt
+		st.StoppedAt = nil
+	})
+
+	if err := s.qemu.StartContext(ctx, vmid); err != nil {
+		s.qemu.log().Error("failed to restart VM", "vmid", vmid, "attempt", attempt, "error", err)
+		now := time.Now()
+		s.qemu.updateState(vmid, func(st *State) {
+			st.StoppedAt = &now
+		})
+	}
+}
+
+func shouldRestart(policy RestartPolicy, state *State) bool {
+	if state.Shutdown == "user" {
+		return false
+	}
+
+	switch policy.Policy {
+	case RestartAlways:
+		return state.Status == StatusCrashed || state.Shutdown == "guest" || state.Shutdown == "host"
+	case RestartOnFailure:
+		if state.Status != StatusCrashed {
+			return false
+		}
+		return policy.MaxRetries == 0 || state.Restarts < policy.MaxRetries
+	default:
+		return false
+	}
+}
@@ -0,0 +1,414 @@
+package goQemu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	TaskPending   = "pending"
+	TaskRunning   = "running"
+	TaskSucceeded = "succeeded"
+	TaskFailed    = "failed"
+	TaskCancelled = "cancelled"
+)
+
+const (
+	maxTaskHistory   = 500
+	taskSaveInterval = time.Second
+)
+
+type Task struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	VMID       int        `json:"vmid,omitempty"`
+	Status     string     `json:"status"`
+	Phase      string     `json:"phase,omitempty"`
+	Progress   Progress   `json:"progress"`
+	Error      string     `json:"error,omitempty"`
+	Log        []TaskLog  `json:"log"`
+	Owner      int        `json:"owner_pid"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// * the created VM, a generated password is only in the first read after the task finished
+	Result *Instance `json:"result,omitempty"`
+
+	mu     sync.Mutex
+	saveMu sync.Mutex
+	qemu   *Qemu
+	cancel context.CancelFunc
+	done   chan struct{}
+	saved  time.Time
+}
+
+type TaskLog struct {
+	At      time.Time `json:"at"`
+	Message string    `json:"message"`
+}
+
+type taskKey struct{}
+
+// * run fn in the background, the returned task is a snapshot
+func (q *Qemu) Async(kind string, vmid int, fn func(ctx context.Context) error) (*Task, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	task := &Task{
+		ID:        uuid.New().String(),
+		Type:      kind,
+		VMID:      vmid,
+		Status:    TaskPending,
+		Log:       []TaskLog{},
+		Owner:     os.Getpid(),
+		CreatedAt: time.Now(),
+		qemu:      q,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+
+	if err := task.save(true); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to save task: %w", err)
+	}
+
+	q.taskMu.Lock()
+	if q.tasks == nil {
+		q.tasks = make(map[string]*Task)
+	}
+	q.tasks[task.ID] = task
+	q.taskMu.Unlock()
+
+	q.pruneTasks()
+
+	go func() {
+		defer close(task.done)
+		defer cancel()
+
+		task.mu.Lock()
+		now := time.Now()
+		task.Status = TaskRunning
+		task.StartedAt = &now
+		task.mu.Unlock()
+		task.save(true)
+
+		err := fn(context.WithValue(ctx, taskKey{}, task))
+
+		task.mu.Lock()
+		now = time.Now()
+		task.FinishedAt = &now
+		task.Phase = ""
+		switch {
+		case err == nil:
+			task.Status = TaskSucceeded
+		case errors.Is(err, context.Canceled):
+			task.Status = TaskCancelled
+			task.Error = err.Error()
+		default:
+			task.Status = TaskFailed
+			task.Error = err.Error()
+		}
+		task.mu.Unlock()
+		task.save(true)
+
+		// * kept until Task or WaitTask hands out the password
+		if !task.hasPassword() {
+			q.taskMu.Lock()
+			delete(q.tasks, task.ID)
+			q.taskMu.Unlock()
+		}
+	}()
+
+	return task.snapshot(), nil
+}
+
+// * an unknown OS or version fails here rather than in the task
+func (q *Qemu) CreateAsync(config Config, ssh string) (*Task, error) {
+	if config.OS == "" || config.Version == "" {
+		return nil, configError("os", "os and version must be specified")
+	}
+	if _, err := q.getOSImageInfo(config.OS, config.Version); err != nil {
+		return nil, err
+	}
+
+	return q.Async("create", config.ID, func(ctx context.Context) error {
+		instance, err := q.createInstance(ctx, config, ssh)
+		if err == nil {
+			taskFrom(ctx).setResult(instance)
+		}
+		return err
+	})
+}
+
+func (q *Qemu) Task(id string) (*Task, error) {
+	q.taskMu.Lock()
+	task, ok := q.tasks[id]
+	q.taskMu.Unlock()
+	if ok {
+		return q.takeTask(task), nil
+	}
+
+	return q.loadTask(id)
+}
+
+// * a finished task leaves memory with this read, taking its password along
+func (q *Qemu) takeTask(task *Task) *Task {
+	snapshot := task.snapshot()
+	select {
+	case <-task.done:
+	default:
+		return snapshot
+	}
+
+	task.mu.Lock()
+	if task.Result != nil {
+		task.Result.Password = ""
+	}
+	task.mu.Unlock()
+
+	q.taskMu.Lock()
+	delete(q.tasks, task.ID)
+	q.taskMu.Unlock()
+
+	return snapshot
+}
+
+// * newest first
+func (q *Qemu) Tasks() ([]*Task, error) {
+	ids, err := q.storage().Keys(KindTask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tasks: %w", err)
+	}
+
+	tasks := make([]*Task, 0, len(ids))
+	for _, id := range ids {
+		q.taskMu.Lock()
+		task, ok := q.tasks[id]
+		q.taskMu.Unlock()
+		if ok {
+			// * listing does not hand out passwords
+			snapshot := task.snapshot()
+			snapshot.Result = withoutPassword(snapshot.Result)
+			tasks = append(tasks, snapshot)
+			continue
+		}
+
+		task, err := q.loadTask(id)
+		if err != nil {
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].CreatedAt.After(tasks[j].CreatedAt)
+	})
+
+	return tasks, nil
+}
+
+func (q *Qemu) CancelTask(id string) error {
+	q.taskMu.Lock()
+	task, ok := q.tasks[id]
+	q.taskMu.Unlock()
+	if !ok {
+		if _, err := q.loadTask(id); err != nil {
+			return err
+		}
+		return fmt.Errorf("task %s is %w in this process", id, ErrNotRunning)
+	}
+
+	task.Logf("cancel requested")
+	task.cancel()
+	return nil
+}
+
+// * block until the task finishes, only for tasks owned by this process
+func (q *Qemu) WaitTask(id string) (*Task, error) {
+	q.taskMu.Lock()
+	task, ok := q.tasks[id]
+	q.taskMu.Unlock()
+	if ok {
+		<-task.done
+		return q.takeTask(task), nil
+	}
+
+	return q.loadTask(id)
+}
+
+func (q *Qemu) loadTask(id string) (*Task, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, fmt.Errorf("task %s %w", id, ErrNotFound)
+	}
+
+	data, err := q.storage().Get(KindTask, id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("task %s %w", id, ErrNotFound)
+		}
+		return nil, err
+	}
+
+	var task Task
+	if err := json.Unmarshal(data, &task); err != nil {
+		return nil, fmt.Errorf("invalid task file: %w", err)
+	}
+
+	// * owner died before finishing
+	if (task.Status == TaskPending || task.Status == TaskRunning) && !processAlive(task.Owner) {
+		task.Status = TaskFailed
+		task.Error = "interrupted"
+	}
+
+	return &task, nil
+}
+
+func (q *Qemu) pruneTasks() {
+	ids, err := q.storage().Keys(KindTask)
+	if err != nil || len(ids) <= maxTaskHistory {
+		return
+	}
+
+	tasks, err := q.Tasks()
+	if err != nil {
+		return
+	}
+
+	// * newest first, unreadable tasks are not listed and go too
+	keep := make(map[string]bool, maxTaskHistory)
+	for _, task := range tasks[:min(maxTaskHistory, len(tasks))] {
+		keep[task.ID] = true
+	}
+	for _, id := range ids {
+		if !keep[id] {
+			q.storage().Delete(KindTask, id)
+		}
+	}
+}
+
+func taskFrom(ctx context.Context) *Task {
+	if ctx == nil {
+		return nil
+	}
+	task, _ := ctx.Value(taskKey{}).(*Task)
+	return task
+}
+
+// * no-op outside of a task
+func setPhase(ctx context.Context, phase string) {
+	if task := taskFrom(ctx); task != nil {
+		task.mu.Lock()
+		task.Phase = phase
+		task.Progress = Progress{}
+		task.mu.Unlock()
+		task.Logf("phase: %s", phase)
+	}
+}
+
+func (t *Task) Logf(format string, args ...any) {
+	t.mu.Lock()
+	t.Log = append(t.Log, TaskLog{
+		At:      time.Now(),
+		Message: fmt.Sprintf(format, args...),
+	})
+	t.mu.Unlock()
+	t.save(true)
+}
+
+func (t *Task) setVMID(vmid int) {
+	t.mu.Lock()
+	t.VMID = vmid
+	t.mu.Unlock()
+	t.save(true)
+}
+
+// * no-op outside of a task
+func (t *Task) setResult(instance *Instance) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.Result = instance
+	t.mu.Unlock()
+	t.save(true)
+}
+
+func (t *Task) hasPassword() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Result != nil && t.Result.Password != ""
+}
+
+func copyInstance(instance *Instance) *Instance {
+	if instance == nil {
+		return nil
+	}
+	copied := *instance
+	return &copied
+}
+
+func withoutPassword(instance *Instance) *Instance {
+	if instance = copyInstance(instance); instance != nil {
+		instance.Password = ""
+	}
+	return instance
+}
+
+func (t *Task) setProgress(completed, total int64) {
+	t.mu.Lock()
+	t.Progress.Completed = completed
+	t.Progress.Total = total
+	t.mu.Unlock()
+	t.save(false)
+}
+
+func (t *Task) snapshot() *Task {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return &Task{
+		ID:         t.ID,
+		Type:       t.Type,
+		VMID:       t.VMID,
+		Status:     t.Status,
+		Phase:      t.Phase,
+		Progress:   Progress{Total: t.Progress.Total, Completed: t.Progress.Completed},
+		Error:      t.Error,
+		Log:        append([]TaskLog(nil), t.Log...),
+		Owner:      t.Owner,
+		CreatedAt:  t.CreatedAt,
+		StartedAt:  t.StartedAt,
+		FinishedAt: t.FinishedAt,
+		Result:     copyInstance(t.Result),
+	}
+}
+
+// * progress updates are throttled, everything else is written immediately
+func (t *Task) save(force bool) error {
+	t.mu.Lock()
+	if !force && time.Since(t.saved) < taskSaveInterval {
+		t.mu.Unlock()
+		return nil
+	}
+	t.saved = time.Now()
+	t.mu.Unlock()
+
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	// * the password never reaches the store
+	snapshot := t.snapshot()
+	snapshot.Result = withoutPassword(snapshot.Result)
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return t.qemu.storage().Put(KindTask, t.ID, data)
+}
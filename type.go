@@ -1,17 +1,24 @@
 package goQemu
 
-import "time"
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
 
 type Config struct {
+	SchemaVersion int    `json:"schema_version"` // * set on save, see migrate.go
 	ID            int    `json:"id"`
 	Hostname      string `json:"hostname"`
 	Accelerator   string `json:"accelerator"`
 	Memory        int    `json:"memory"`
 	CPUs          int    `json:"cpus"` // TODO: expand to sockets, cores, threads
 	BIOS          string `json:"bios"`
-	DiskPath      string `json:"disk_path"`
 	DiskSize      string `json:"disk_size"`
 	CloudInitPath string `json:"cloud_init_path"`
+	CloudInitHash string `json:"cloud_init_hash,omitempty"` // * sha256 of the rendered ISO files
 	OS            string `json:"os"`
 	Version       string `json:"version"`
 	// Username         string    `json:"username"`
@@ -19,10 +26,25 @@ type Config struct {
 	// SSHAuthorizedKey string    `json:"ssh_key"`
 	VNCPort int `json:"vnc_port"`
 	// UUID      string    `json:"uuid"`
-	// Network   []Network `json:"network"`
-	Network   []string  `json:"network"`
-	CloudInit CloudInit `json:"cloud_init"`
-	Options   Options   `json:"options"`
+	Disks      []Disk        `json:"disks"`
+	Network    []Network     `json:"network"`
+	CloudInit  CloudInit     `json:"cloud_init"`
+	Options    Options       `json:"options"`
+	Restart    RestartPolicy `json:"restart"`
+	OnBoot     bool          `json:"onboot"`
+	StartOrder int           `json:"start_order"` // ascending, 0 starts last
+	StartDelay int           `json:"start_delay"` // seconds to wait before next VM
+}
+
+type RestartPolicy struct {
+	Policy     string `json:"policy"` // never, on-failure, always
+	MaxRetries int    `json:"max_retries"`
+	Backoff    int    `json:"backoff"` // seconds, doubled on each retry
+}
+
+type Disk struct {
+	Path   string `json:"path"`
+	Format string `json:"format"` // qcow2, raw
 }
 
 type Network struct {
@@ -47,16 +69,72 @@ type IPConfig struct {
 
 type CloudInit struct {
 	// OS               string         `json:"os"`
-	Hostname        string   `json:"hostname"`
-	Username        string   `json:"username"`
-	Password        string   `json:"passwd"`
-	AuthorizedKey   string   `json:"authorized_key"`
+	Hostname string `json:"hostname"`
+	Username string `json:"username"`
+	// * input only, hashed into passwd_hash before the config is saved
+	Password      string `json:"passwd,omitempty"`
+	PasswordHash  string `json:"passwd_hash,omitempty"`
+	AuthorizedKey string `json:"authorized_key"` // * one key per line
+	// * nil keeps password login over SSH enabled
+	SSHPasswordAuth *bool    `json:"ssh_pwauth,omitempty"`
 	UpgradePackages bool     `json:"upgrade_packages"`
 	DNSDomain       string   `json:"dns_domain"`
 	DNSServers      []string `json:"dns_servers"`
 	IPv4            string   `json:"ipv4"`
 	IPv6            string   `json:"ipv6"`
 	// NetworkConfig   *NetworkConfig `json:"network_config,omitempty"`
+
+	// * "gh:<name>" sources for the default user, fetched into authorized_key on
+	// * Create and Update
+	ImportKeys []string `json:"import_keys,omitempty"`
+	// * replaces the default user built from username, passwd and authorized_key
+	Users []User `json:"users,omitempty"`
+
+	// * added to what the package needs, qemu-guest-agent and its runcmd stay first
+	Packages   []string    `json:"packages,omitempty"`
+	WriteFiles []WriteFile `json:"write_files,omitempty"`
+	Runcmd     []string    `json:"runcmd,omitempty"`
+	Bootcmd    []string    `json:"bootcmd,omitempty"`
+	// * raw user-data merged into the generated one: #cloud-config is merged key by key,
+	// * scripts and multipart MIME parts are sent along as extra parts
+	UserData string `json:"user_data,omitempty"`
+}
+
+type User struct {
+	Name       string   `json:"name"`
+	Groups     []string `json:"groups,omitempty"`
+	Sudo       string   `json:"sudo,omitempty"`  // * sudoers rule, e.g. ALL=(ALL) NOPASSWD:ALL; empty for none
+	Shell      string   `json:"shell,omitempty"` // * default /bin/bash
+	SSHKeys    []string `json:"ssh_keys,omitempty"`
+	ImportKeys []string `json:"import_keys,omitempty"` // * fetched into ssh_keys on Create and Update
+	LockPasswd *bool    `json:"lock_passwd,omitempty"` // * false when unset and a password is given
+	// * input only, hashed into hashed_passwd before the config is saved
+	Password string `json:"passwd,omitempty"`
+	// * crypt(3) hash, e.g. from mkpasswd -m sha-512
+	HashedPasswd string `json:"hashed_passwd,omitempty"`
+}
+
+type WriteFile struct {
+	Path        string `json:"path"`
+	Content     string `json:"content"`
+	Owner       string `json:"owner,omitempty"`       // * user:group, default root:root
+	Permissions string `json:"permissions,omitempty"` // * octal, e.g. 0644
+	Base64      bool   `json:"base64,omitempty"`      // * content is base64, for binary files
+	Append      bool   `json:"append,omitempty"`
+}
+
+// * nil fields are left unchanged, CloudInit replaces the whole section
+type ConfigPatch struct {
+	Hostname   *string        `json:"hostname,omitempty"`
+	Memory     *int           `json:"memory,omitempty"`
+	CPUs       *int           `json:"cpus,omitempty"`
+	BIOS       *string        `json:"bios,omitempty"`
+	Network    []Network      `json:"network,omitempty"`
+	CloudInit  *CloudInit     `json:"cloud_init,omitempty"`
+	Restart    *RestartPolicy `json:"restart,omitempty"`
+	OnBoot     *bool          `json:"onboot,omitempty"`
+	StartOrder *int           `json:"start_order,omitempty"`
+	StartDelay *int           `json:"start_delay,omitempty"`
 }
 
 type Options struct {
@@ -69,11 +147,42 @@ type Options struct {
 // }
 
 type Instance struct {
-	Config    Config     `json:"config"`
-	PID       int        `json:"pid"`
-	Status    string     `json:"status"`
-	CreatedAt time.Time  `json:"created_at"`
-	StoppedAt *time.Time `json:"stopped_at,omitempty"`
+	Config     Config     `json:"config"`
+	PID        int        `json:"pid"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	StoppedAt  *time.Time `json:"stopped_at,omitempty"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	ExitReason string     `json:"exit_reason,omitempty"`
+	LogTail    string     `json:"log_tail,omitempty"`
+	Lock       *LockInfo  `json:"lock,omitempty"` // operation holding the VM
+	Pending    []string   `json:"pending,omitempty"`
+	// * set by CreateInstance only, when the login password was generated
+	Password string `json:"password,omitempty"`
+}
+
+type State struct {
+	Status     string       `json:"status"`
+	PID        int          `json:"pid"`
+	CreatedAt  time.Time    `json:"created_at"`
+	StartedAt  *time.Time   `json:"started_at,omitempty"`
+	StoppedAt  *time.Time   `json:"stopped_at,omitempty"`
+	UpdatedAt  time.Time    `json:"updated_at"`
+	ExitCode   *int         `json:"exit_code,omitempty"`
+	ExitReason string       `json:"exit_reason,omitempty"`
+	LogTail    string       `json:"log_tail,omitempty"`
+	Shutdown   string       `json:"shutdown,omitempty"` // user, guest, host
+	Restarts   int          `json:"restarts"`
+	Pending    []string     `json:"pending,omitempty"` // config fields waiting for a restart
+	History    []Transition `json:"history"`
+}
+
+type Transition struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
 }
 
 type Image struct {
@@ -84,20 +193,54 @@ type Image struct {
 }
 
 type Qemu struct {
-	Folder Folder
-	Binary string
+	Folder  Folder
+	Binary  string
+	stateMu sync.Mutex
+	taskMu  sync.Mutex
+	tasks   map[string]*Task
+	lockMu  sync.Mutex
+	locks   map[int]*LockInfo
+	// * in-flight image downloads by path, closed when done
+	downloadMu sync.Mutex
+	downloads  map[string]chan struct{}
+	// * receives progress, lifecycle and warning events, nil discards them
+	Observer Observer
+
+	// * set through Option
+	path          string
+	vmidStart     int
+	vmidEnd       int
+	password      string
+	catalog       map[string][]string
+	logger        *slog.Logger
+	httpClient    *http.Client
+	keepArtifacts bool
+	store         Store
+	storeName     string   // * dir or bolt, from GO_QEMU_STORE
+	ownStore      bool     // * opened by NewQemu, closed by Close
+	seedURL       string   // * NoCloud-Net seed instead of the ISO when set
+	keySource     string   // * where gh:<name> keys come from, %s is the name
+	envFiles      []string // * .env files read by WithEnv, passed on to the systemd unit
 }
 
 type Folder struct {
-	VM      string
-	Config  string
-	Log     string
-	PID     string
-	Monitor string
-	Image   string
+	VM       string
+	Config   string
+	Log      string
+	PID      string
+	Monitor  string
+	Image    string
+	State    string
+	Task     string
+	Lock     string
+	Snapshot string
 }
 
 type Progress struct {
-	Total     int64
-	Completed int64
+	Total     int64           `json:"total"`
+	Completed int64           `json:"completed"`
+	ctx       context.Context // * owning task and cancellation, may be nil
+	qemu      *Qemu           // * event target, may be nil
+	vmid      int
+	phase     string
 }
@@ -0,0 +1,299 @@
+package goQemu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+func (q *Qemu) Update(vmid int, patch ConfigPatch) (*Instance, error) {
+	return q.UpdateContext(context.Background(), vmid, patch)
+}
+
+// * a stopped VM takes every change at once; a running VM gets what can be applied live,
+// * the rest is saved and listed in Instance.Pending until the next start
+func (q *Qemu) UpdateContext(ctx context.Context, vmid int, patch ConfigPatch) (*Instance, error) {
+	ctx, unlock, err := q.lock(ctx, vmid, "update")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	prior, err := q.readConfig(vmid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := q.updateConfig(ctx, vmid, *prior, patch); err != nil {
+		return nil, err
+	}
+
+	return q.GetContext(ctx, vmid)
+}
+
+// * swap back to the config saved by the last Update, a second Revert undoes the first
+func (q *Qemu) Revert(vmid int) (*Instance, error) {
+	return q.RevertContext(context.Background(), vmid)
+}
+
+func (q *Qemu) RevertContext(ctx context.Context, vmid int) (*Instance, error) {
+	ctx, unlock, err := q.lock(ctx, vmid, "revert")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	current, err := q.readConfig(vmid)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := q.storage().Get(KindConfig, priorConfigKey(vmid))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("prior config of VM %d %w", vmid, ErrNotFound)
+		}
+		return nil, err
+	}
+
+	// * may predate the current schema, upgrade without rewriting it
+	upgraded, _, err := migrateConfig(data)
+	if err != nil {
+		return nil, configError("schema_version", "invalid prior config file for VM %d: %s", vmid, err)
+	}
+	prior, err := decodeConfig(vmid, upgraded)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := q.updateConfig(ctx, vmid, *current, patchFrom(*prior)); err != nil {
+		return nil, err
+	}
+
+	return q.GetContext(ctx, vmid)
+}
+
+func priorConfigKey(vmid int) string {
+	return fmt.Sprintf("%d.prev", vmid)
+}
+
+func (q *Qemu) updateConfig(ctx context.Context, vmid int, prior Config, patch ConfigPatch) error {
+	config := prior
+	changed, err := applyPatch(&config, patch)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	if slices.Contains(changed, "cloud_init") {
+		if err := q.importSSHKeys(ctx, &config.CloudInit); err != nil {
+			return err
+		}
+		if err := sealPasswords(&config.CloudInit); err != nil {
+			return err
+		}
+	}
+
+	checked, err := q.checkConfig(config)
+	if err != nil {
+		return err
+	}
+	config = *checked
+
+	// * a failed build keeps the old ISO, nothing to undo
+	if slices.Contains(changed, "cloud_init") {
+		setPhase(ctx, "generate cloud-init")
+		if _, err := q.ensureCloudInit(ctx, &config); err != nil {
+			return fmt.Errorf("failed to generate cloud-init: %w", err)
+		}
+	}
+
+	prior.SchemaVersion = configSchema
+	data, err := json.MarshalIndent(prior, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := q.storage().Put(KindConfig, priorConfigKey(vmid), data); err != nil {
+		return fmt.Errorf("failed to save prior config: %w", err)
+	}
+
+	if err := q.saveConfig(config); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+
+	pending := q.applyLive(ctx, vmid, config, changed)
+	q.updateState(vmid, func(s *State) {
+		// * applied live, the running VM matches the config again
+		s.Pending = slices.DeleteFunc(s.Pending, func(field string) bool {
+			return slices.Contains(changed, field) && !slices.Contains(pending, field)
+		})
+		for _, field := range pending {
+			if !slices.Contains(s.Pending, field) {
+				s.Pending = append(s.Pending, field)
+			}
+		}
+		slices.Sort(s.Pending)
+	})
+
+	if len(pending) > 0 {
+		q.infof(vmid, "VM %d updated: %s (pending restart: %s)", vmid, strings.Join(changed, ", "), strings.Join(pending, ", "))
+		return nil
+	}
+
+	q.infof(vmid, "VM %d updated: %s", vmid, strings.Join(changed, ", "))
+	return nil
+}
+
+// * fields the running VM could not take
+func (q *Qemu) applyLive(ctx context.Context, vmid int, config Config, changed []string) []string {
+	var pid int
+	if _, pidData, err := q.getFile(q.Folder.PID, vmid); err == nil {
+		fmt.Sscanf(pidData, "%d", &pid)
+	}
+	if !q.isRunning(vmid, pid) {
+		return nil
+	}
+
+	var pending []string
+	for _, field := range changed {
+		switch field {
+		case "restart", "onboot", "start_order", "start_delay":
+			// * read by this package only, nothing to apply
+		case "memory":
+			// * the balloon moves anywhere up to the memory the VM booted with
+			booted, err := q.bootedMemory(ctx, vmid)
+			if err == nil && config.Memory <= booted {
+				args := map[string]any{"value": int64(config.Memory) << 20}
+				if _, err = q.qmpExecute(ctx, vmid, "balloon", args); err == nil {
+					continue
+				}
+			}
+			if err != nil {
+				q.warn(vmid, "failed to resize memory live", err)
+			}
+			pending = append(pending, field)
+		default:
+			// * hostname included, cloud-init sets it from meta-data on the next boot
+			pending = append(pending, field)
+		}
+	}
+
+	return pending
+}
+
+// * MiB the VM was started with, the ceiling for the balloon
+func (q *Qemu) bootedMemory(ctx context.Context, vmid int) (int, error) {
+	data, err := q.qmpExecute(ctx, vmid, "query-memory-size-summary", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var summary struct {
+		BaseMemory int64 `json:"base-memory"`
+	}
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return 0, fmt.Errorf("invalid query-memory-size-summary response: %w", err)
+	}
+
+	return int(summary.BaseMemory >> 20), nil
+}
+
+// * names of the fields that differ after the patch, only those are validated
+func applyPatch(config *Config, patch ConfigPatch) ([]string, error) {
+	var changed []string
+
+	if patch.Hostname != nil && *patch.Hostname != config.Hostname {
+		if *patch.Hostname == "" {
+			return nil, configError("hostname", "hostname must be specified")
+		}
+		config.Hostname = *patch.Hostname
+		changed = append(changed, "hostname")
+	}
+
+	if patch.Memory != nil && *patch.Memory != config.Memory {
+		if *patch.Memory <= 0 {
+			return nil, configError("memory", "memory must be positive")
+		}
+		config.Memory = *patch.Memory
+		changed = append(changed, "memory")
+	}
+
+	if patch.CPUs != nil && *patch.CPUs != config.CPUs {
+		if *patch.CPUs <= 0 {
+			return nil, configError("cpus", "cpus must be positive")
+		}
+		config.CPUs = *patch.CPUs
+		changed = append(changed, "cpus")
+	}
+
+	if patch.BIOS != nil && *patch.BIOS != config.BIOS {
+		switch strings.ToLower(*patch.BIOS) {
+		case "", "seabios", "ovmf":
+		default:
+			return nil, configError("bios", "unsupported BIOS: %s", *patch.BIOS)
+		}
+		config.BIOS = *patch.BIOS
+		changed = append(changed, "bios")
+	}
+
+	if patch.Network != nil && !slices.Equal(patch.Network, config.Network) {
+		for i, net := range patch.Network {
+			if net.Bridge == "" || net.Model == "" {
+				return nil, configError(fmt.Sprintf("network[%d]", i), "bridge and model must be specified")
+			}
+		}
+		config.Network = patch.Network
+		changed = append(changed, "network")
+	}
+
+	if patch.CloudInit != nil && !reflect.DeepEqual(*patch.CloudInit, config.CloudInit) {
+		config.CloudInit = *patch.CloudInit
+		changed = append(changed, "cloud_init")
+	}
+
+	if patch.Restart != nil && *patch.Restart != config.Restart {
+		config.Restart = *patch.Restart
+		changed = append(changed, "restart")
+	}
+
+	if patch.OnBoot != nil && *patch.OnBoot != config.OnBoot {
+		config.OnBoot = *patch.OnBoot
+		changed = append(changed, "onboot")
+	}
+
+	if patch.StartOrder != nil && *patch.StartOrder != config.StartOrder {
+		config.StartOrder = *patch.StartOrder
+		changed = append(changed, "start_order")
+	}
+
+	if patch.StartDelay != nil && *patch.StartDelay != config.StartDelay {
+		if *patch.StartDelay < 0 {
+			return nil, configError("start_delay", "start_delay must not be negative")
+		}
+		config.StartDelay = *patch.StartDelay
+		changed = append(changed, "start_delay")
+	}
+
+	return changed, nil
+}
+
+func patchFrom(config Config) ConfigPatch {
+	return ConfigPatch{
+		Hostname:   &config.Hostname,
+		Memory:     &config.Memory,
+		CPUs:       &config.CPUs,
+		BIOS:       &config.BIOS,
+		Network:    config.Network,
+		CloudInit:  &config.CloudInit,
+		Restart:    &config.Restart,
+		OnBoot:     &config.OnBoot,
+		StartOrder: &config.StartOrder,
+		StartDelay: &config.StartDelay,
+	}
+}
@@ -0,0 +1,346 @@
+package goQemu
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// * lists appended when user-data is merged, everything else is replaced;
+// * cloud-init's own merger replaces lists and would drop qemu-guest-agent
+var appendKeys = map[string]bool{
+	"packages":            true,
+	"write_files":         true,
+	"bootcmd":             true,
+	"runcmd":              true,
+	"users":               true,
+	"ssh_authorized_keys": true,
+}
+
+// * first line of a single part and the MIME type cloud-init expects for it
+var userDataTypes = []struct {
+	prefix   string
+	mimeType string
+}{
+	{"#cloud-config", "text/cloud-config"},
+	{"#!", "text/x-shellscript"},
+	{"#cloud-boothook", "text/cloud-boothook"},
+	{"#include", "text/x-include-url"},
+	{"#part-handler", "text/part-handler"},
+}
+
+var (
+	validOwner       = regexp.MustCompile(`^[a-z_][a-z0-9_-]*(:[a-z_][a-z0-9_-]*)?$`)
+	validPermissions = regexp.MustCompile(`^0?[0-7]{3,4}$`)
+)
+
+type userDataPart struct {
+	mimeType string
+	filename string
+	content  string
+}
+
+func checkCloudInitExtras(cloudInit CloudInit) error {
+	for i, name := range cloudInit.Packages {
+		if name == "" || strings.ContainsAny(name, " \t\r\n") {
+			return configError(fmt.Sprintf("cloud_init.packages[%d]", i), "invalid package name: %q", name)
+		}
+	}
+
+	for i, file := range cloudInit.WriteFiles {
+		field := fmt.Sprintf("cloud_init.write_files[%d]", i)
+		if !path.IsAbs(file.Path) || path.Clean(file.Path) != file.Path {
+			return configError(field+".path", "path must be absolute and clean: %q", file.Path)
+		}
+		if file.Owner != "" && !validOwner.MatchString(file.Owner) {
+			return configError(field+".owner", "invalid owner: %q", file.Owner)
+		}
+		if file.Permissions != "" && !validPermissions.MatchString(file.Permissions) {
+			return configError(field+".permissions", "permissions must be octal, e.g. 0644: %q", file.Permissions)
+		}
+		if file.Base64 {
+			if _, err := base64.StdEncoding.DecodeString(file.Content); err != nil {
+				return configError(field+".content", "invalid base64: %v", err)
+			}
+		}
+	}
+
+	for name, commands := range map[string][]string{"bootcmd": cloudInit.Bootcmd, "runcmd": cloudInit.Runcmd} {
+		for i, command := range commands {
+			if strings.TrimSpace(command) == "" {
+				return configError(fmt.Sprintf("cloud_init.%s[%d]", name, i), "command must not be empty")
+			}
+		}
+	}
+
+	if cloudInit.UserData != "" {
+		if _, _, err := parseUserData(cloudInit.UserData); err != nil {
+			return configError("cloud_init.user_data", "%v", err)
+		}
+	}
+
+	return nil
+}
+
+// * base then extra, first occurrence kept
+func uniqueStrings(base, extra []string) []string {
+	seen := make(map[string]bool, len(base)+len(extra))
+	list := make([]string, 0, len(base)+len(extra))
+	for _, values := range [][]string{base, extra} {
+		for _, value := range values {
+			if !seen[value] {
+				seen[value] = true
+				list = append(list, value)
+			}
+		}
+	}
+	return list
+}
+
+func cloudWriteFiles(files []WriteFile) []cloudWriteFile {
+	var list []cloudWriteFile
+	for _, file := range files {
+		entry := cloudWriteFile{
+			Path:        file.Path,
+			Content:     file.Content,
+			Owner:       file.Owner,
+			Permissions: file.Permissions,
+			Append:      file.Append,
+		}
+		if file.Base64 {
+			entry.Encoding = "b64"
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+// * the generated #cloud-config, merged with raw user-data when given; other
+// * parts of it turn the result into multipart MIME with ours first
+func renderUserData(userData cloudConfig, raw string) (string, error) {
+	if raw == "" {
+		return marshalYAML("#cloud-config\n", userData)
+	}
+
+	configs, parts, err := parseUserData(raw)
+	if err != nil {
+		return "", configError("cloud_init.user_data", "%v", err)
+	}
+
+	// * typed struct to a plain map, so unknown keys from raw fit in
+	generated, err := marshalYAML("", userData)
+	if err != nil {
+		return "", err
+	}
+	var merged map[string]any
+	if err := yaml.Unmarshal([]byte(generated), &merged); err != nil {
+		return "", fmt.Errorf("failed to merge user-data: %w", err)
+	}
+	for _, config := range configs {
+		mergeCloudConfig(merged, config)
+	}
+
+	text, err := marshalYAML("#cloud-config\n", merged)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) == 0 {
+		return text, nil
+	}
+
+	return buildMultipart(append([]userDataPart{{mimeType: "text/cloud-config", filename: "cloud-config.txt", content: text}}, parts...))
+}
+
+func mergeCloudConfig(dst, src map[string]any) {
+	for key, value := range src {
+		if appendKeys[key] {
+			base, ok1 := dst[key].([]any)
+			extra, ok2 := value.([]any)
+			if ok1 && ok2 {
+				dst[key] = appendUnique(base, extra)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+// * plain strings are deduplicated, e.g. a package listed twice
+func appendUnique(base, extra []any) []any {
+	seen := make(map[string]bool)
+	for _, value := range base {
+		if s, ok := value.(string); ok {
+			seen[s] = true
+		}
+	}
+
+	for _, value := range extra {
+		if s, ok := value.(string); ok {
+			if seen[s] {
+				continue
+			}
+			seen[s] = true
+		}
+		base = append(base, value)
+	}
+	return base
+}
+
+// * #cloud-config documents to merge and the remaining parts to pass along
+func parseUserData(raw string) ([]map[string]any, []userDataPart, error) {
+	firstLine, _, _ := strings.Cut(strings.TrimLeft(raw, "\r\n"), "\n")
+	firstLine = strings.ToLower(firstLine)
+	if strings.HasPrefix(firstLine, "content-type:") || strings.HasPrefix(firstLine, "mime-version:") {
+		return parseMultipart(raw)
+	}
+
+	part, err := detectPart(userDataPart{content: raw})
+	if err != nil {
+		return nil, nil, err
+	}
+	return collectParts([]userDataPart{part})
+}
+
+func parseMultipart(raw string) ([]map[string]any, []userDataPart, error) {
+	message, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid MIME user-data: %w", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid MIME user-data: %w", err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return parseUserData(readAllString(message.Body))
+	}
+
+	var parts []userDataPart
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid MIME user-data: %w", err)
+		}
+
+		var body io.Reader = part
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+			body = base64.NewDecoder(base64.StdEncoding, part)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid MIME part %q: %w", part.FileName(), err)
+		}
+
+		entry := userDataPart{filename: part.FileName(), content: string(data)}
+		if value := part.Header.Get("Content-Type"); value != "" {
+			if entry.mimeType, _, err = mime.ParseMediaType(value); err != nil {
+				return nil, nil, fmt.Errorf("invalid MIME part %q: %w", part.FileName(), err)
+			}
+		}
+		if strings.HasPrefix(entry.mimeType, "multipart/") {
+			return nil, nil, fmt.Errorf("nested multipart user-data is not supported")
+		}
+		if entry.mimeType == "" || entry.mimeType == "text/plain" {
+			if entry, err = detectPart(entry); err != nil {
+				return nil, nil, err
+			}
+		}
+		parts = append(parts, entry)
+	}
+
+	return collectParts(parts)
+}
+
+func detectPart(part userDataPart) (userDataPart, error) {
+	for _, t := range userDataTypes {
+		if strings.HasPrefix(part.content, t.prefix) {
+			part.mimeType = t.mimeType
+			return part, nil
+		}
+	}
+	return part, fmt.Errorf("unsupported user-data, expected #cloud-config, a #! script or multipart MIME")
+}
+
+func collectParts(parts []userDataPart) ([]map[string]any, []userDataPart, error) {
+	var configs []map[string]any
+	var others []userDataPart
+	for _, part := range parts {
+		if part.mimeType != "text/cloud-config" {
+			others = append(others, part)
+			continue
+		}
+
+		var config map[string]any
+		if err := yaml.Unmarshal([]byte(part.content), &config); err != nil {
+			return nil, nil, fmt.Errorf("invalid #cloud-config: %w", err)
+		}
+		if config != nil {
+			configs = append(configs, config)
+		}
+	}
+	return configs, others, nil
+}
+
+// * the boundary is derived from the content so equal input renders equal output
+// * and the cloud-init hash stays stable
+func buildMultipart(parts []userDataPart) (string, error) {
+	hash := sha256.New()
+	for _, part := range parts {
+		fmt.Fprintf(hash, "%s\x00%s\x00", part.mimeType, part.content)
+	}
+	boundary := "goqemu-" + hex.EncodeToString(hash.Sum(nil))[:32]
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\nMIME-Version: 1.0\n\n", boundary)
+
+	writer := multipart.NewWriter(&buf)
+	if err := writer.SetBoundary(boundary); err != nil {
+		return "", err
+	}
+	for i, part := range parts {
+		filename := part.filename
+		if filename == "" {
+			filename = fmt.Sprintf("part-%03d", i+1)
+		}
+
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", mime.FormatMediaType(part.mimeType, map[string]string{"charset": "utf-8"}))
+		header.Set("MIME-Version", "1.0")
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.WriteString(w, part.content); err != nil {
+			return "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+func readAllString(r io.Reader) string {
+	data, _ := io.ReadAll(r)
+	return string(data)
+}
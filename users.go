@@ -0,0 +1,243 @@
+package goQemu
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const defaultKeySource = "https://github.com/%s.keys"
+
+var validKeyName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]{0,38}$`)
+
+// * where gh:<name> keys are fetched from, %s is replaced by the name; an
+// * http(s) URL or a local file path, e.g. /srv/keys/%s.keys
+func WithKeySource(source string) Option {
+	return func(q *Qemu) error {
+		if strings.Count(source, "%s") != 1 {
+			return fmt.Errorf("key source must contain one %%s: %s", source)
+		}
+		q.keySource = source
+		return nil
+	}
+}
+
+// * fetch import_keys into the keys saved with the config, so boot never
+// * depends on the key source being reachable
+func (q *Qemu) importSSHKeys(ctx context.Context, cloudInit *CloudInit) error {
+	if len(cloudInit.ImportKeys) > 0 {
+		keys, err := q.fetchSSHKeys(ctx, "cloud_init.import_keys", cloudInit.ImportKeys)
+		if err != nil {
+			return err
+		}
+		cloudInit.AuthorizedKey = strings.Join(uniqueStrings(splitKeys(cloudInit.AuthorizedKey), keys), "\n")
+	}
+
+	for i := range cloudInit.Users {
+		user := &cloudInit.Users[i]
+		if len(user.ImportKeys) == 0 {
+			continue
+		}
+		keys, err := q.fetchSSHKeys(ctx, fmt.Sprintf("cloud_init.users[%d].import_keys", i), user.ImportKeys)
+		if err != nil {
+			return err
+		}
+		user.SSHKeys = uniqueStrings(user.SSHKeys, keys)
+	}
+
+	// * the default user without any key gets the host user's, saved with the config
+	// * so rendering never reads ~/.ssh
+	if len(cloudInit.Users) == 0 && len(splitKeys(cloudInit.AuthorizedKey)) == 0 {
+		key, err := hostSSHKey(ctx)
+		if err != nil {
+			return err
+		}
+		cloudInit.AuthorizedKey = key
+	}
+
+	return nil
+}
+
+func (q *Qemu) fetchSSHKeys(ctx context.Context, field string, sources []string) ([]string, error) {
+	var keys []string
+	for _, source := range sources {
+		name, ok := strings.CutPrefix(source, "gh:")
+		if !ok || !validKeyName.MatchString(name) {
+			return nil, configError(field, "invalid key source %q, expected gh:<name>", source)
+		}
+
+		data, err := q.readKeySource(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to import keys for %s: %w", source, err)
+		}
+
+		found := splitKeys(data)
+		if len(found) == 0 {
+			return nil, fmt.Errorf("failed to import keys for %s: no keys found", source)
+		}
+		keys = append(keys, found...)
+	}
+	return keys, nil
+}
+
+func (q *Qemu) readKeySource(ctx context.Context, name string) (string, error) {
+	source := q.keySource
+	if source == "" {
+		source = defaultKeySource
+	}
+	location := fmt.Sprintf(source, name)
+
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		data, err := os.ReadFile(strings.TrimPrefix(location, "file://"))
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := q.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", location, resp.Status)
+	}
+
+	// * a key list is small, anything larger is not one
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// * authorized_keys lines, comments and blanks dropped
+func splitKeys(value string) []string {
+	var keys []string
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys
+}
+
+var validHashedPasswd = regexp.MustCompile(`^\$[0-9a-z]+\$[^\s:]+$`)
+
+func checkUsers(users []User) error {
+	seen := make(map[string]bool, len(users))
+	for i, user := range users {
+		field := fmt.Sprintf("cloud_init.users[%d]", i)
+		if !validUsername.MatchString(user.Name) {
+			return configError(field+".name", "invalid username: %q", user.Name)
+		}
+		if seen[user.Name] {
+			return configError(field+".name", "duplicate user: %s", user.Name)
+		}
+		seen[user.Name] = true
+
+		for _, group := range user.Groups {
+			if !validUsername.MatchString(group) {
+				return configError(field+".groups", "invalid group: %q", group)
+			}
+		}
+		// * a line break would add rules to sudoers
+		if strings.ContainsAny(user.Sudo, "\r\n") {
+			return configError(field+".sudo", "sudo rule must be a single line")
+		}
+		if user.Shell != "" && (!strings.HasPrefix(user.Shell, "/") || strings.ContainsAny(user.Shell, " \t\r\n")) {
+			return configError(field+".shell", "shell must be an absolute path: %q", user.Shell)
+		}
+		for _, key := range user.SSHKeys {
+			if strings.TrimSpace(key) == "" || strings.ContainsAny(key, "\r\n") {
+				return configError(field+".ssh_keys", "each key must be a single non-empty line")
+			}
+		}
+		if strings.ContainsAny(user.Password, "\r\n") {
+			return configError(field+".passwd", "password must not contain line breaks")
+		}
+		if user.HashedPasswd != "" && !validHashedPasswd.MatchString(user.HashedPasswd) {
+			return configError(field+".hashed_passwd", "expected a crypt(3) hash such as $6$salt$hash")
+		}
+	}
+	return nil
+}
+
+// * a password that was never sealed is hashed with a salt derived from seed
+func cloudUsers(users []User, seed string) []cloudUser {
+	list := make([]cloudUser, 0, len(users))
+	for _, user := range users {
+		shell := user.Shell
+		if shell == "" {
+			shell = "/bin/bash"
+		}
+		passwd := user.HashedPasswd
+		if user.Password != "" {
+			passwd = sha512Crypt(user.Password, stableSalt(seed+"\x00"+user.Name), 0)
+		}
+		// * cloud-init locks the password by default, which would make the one given useless
+		lockPasswd := user.LockPasswd
+		if lockPasswd == nil && passwd != "" {
+			unlocked := false
+			lockPasswd = &unlocked
+		}
+		list = append(list, cloudUser{
+			Name:              user.Name,
+			Groups:            strings.Join(user.Groups, ","),
+			Sudo:              user.Sudo,
+			SSHAuthorizedKeys: user.SSHKeys,
+			Shell:             shell,
+			LockPasswd:        lockPasswd,
+			Passwd:            passwd,
+		})
+	}
+	return list
+}
+
+// * replace cleartext passwords with SHA-512 crypt hashes, so only hashes are saved
+func sealPasswords(cloudInit *CloudInit) error {
+	if cloudInit.Password != "" {
+		if strings.ContainsAny(cloudInit.Password, "\r\n") {
+			return configError("cloud_init.passwd", "password must not contain line breaks")
+		}
+		hash, err := hashPassword(cloudInit.Password)
+		if err != nil {
+			return err
+		}
+		cloudInit.PasswordHash = hash
+		cloudInit.Password = ""
+	}
+
+	// * the slice may be shared with the caller's copy of the config
+	cloudInit.Users = slices.Clone(cloudInit.Users)
+	for i := range cloudInit.Users {
+		user := &cloudInit.Users[i]
+		if user.Password == "" {
+			continue
+		}
+		if strings.ContainsAny(user.Password, "\r\n") {
+			return configError(fmt.Sprintf("cloud_init.users[%d].passwd", i), "password must not contain line breaks")
+		}
+		hash, err := hashPassword(user.Password)
+		if err != nil {
+			return err
+		}
+		user.HashedPasswd = hash
+		user.Password = ""
+	}
+
+	return nil
+}
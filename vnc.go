@@ -1,9 +1,10 @@
 package goQemu
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -12,37 +13,99 @@ import (
 )
 
 func (q *Qemu) OpenVNC(vmid int) error {
-	config, err := q.loadConfig(vmid)
+	return q.OpenVNCContext(context.Background(), vmid)
+}
+
+func (q *Qemu) OpenVNCContext(ctx context.Context, vmid int) error {
+	url, err := q.VNCAddressContext(ctx, vmid)
+	if err != nil {
+		return err
+	}
+
+	// * the password stays out of events, only VNCAddress returns it
+	q.infof(vmid, "VNC: %s", redactURL(url))
+
+	return nil
+}
+
+func (q *Qemu) VNCAddress(vmid int) (string, error) {
+	return q.VNCAddressContext(context.Background(), vmid)
+}
+
+func (q *Qemu) VNCAddressContext(ctx context.Context, vmid int) (string, error) {
+	config, err := q.loadConfig(ctx, vmid)
 	if err != nil {
-		return fmt.Errorf("failed to get VM (%d): %w", vmid, err)
+		return "", fmt.Errorf("failed to get VM (%d): %w", vmid, err)
 	}
 
 	if config.VNCPort == 0 {
-		return fmt.Errorf("VM (%d) is not enabled", vmid)
+		return "", fmt.Errorf("VM (%d) is not enabled", vmid)
 	}
 
 	var pid int
 	if _, data, err := q.getFile(q.Folder.PID, vmid); err == nil {
 		fmt.Sscanf(data, "%d", &pid)
-		if !q.isRunning(pid) {
-			return fmt.Errorf("VM (%d) is not running", vmid)
+		if !q.isRunning(vmid, pid) {
+			return "", fmt.Errorf("VM (%d) is %w", vmid, ErrNotRunning)
 		}
 	} else {
-		return fmt.Errorf("VM (%d) is not running", vmid)
+		return "", fmt.Errorf("VM (%d) is %w", vmid, ErrNotRunning)
 	}
 
-	ip, err := q.getHostIP()
+	ip, err := q.getHostIP(ctx)
 	if err != nil {
 		ip = "localhost"
 	}
 
-	fmt.Printf("vnc://%s:%d\n", ip, config.VNCPort)
+	// * the password is regenerated on every start
+	if password, err := q.readVNCPassword(vmid); err == nil && password != "" {
+		return fmt.Sprintf("vnc://:%s@%s:%d", password, ip, config.VNCPort), nil
+	}
+	return fmt.Sprintf("vnc://%s:%d", ip, config.VNCPort), nil
+}
 
-	return nil
+// * kept beside the monitor sockets, readable by the owner only and never in the state
+func (q *Qemu) vncPasswordPath(vmid int) string {
+	return filepath.Join(q.Folder.Monitor, fmt.Sprintf("%d.vnc", vmid))
 }
 
-func (q *Qemu) getHostIP() (string, error) {
-	cmd := exec.Command("ip", "addr", "show", "vmbr0")
+func (q *Qemu) saveVNCPassword(vmid int, password string) error {
+	path := q.vncPasswordPath(vmid)
+	// * a new file, so the mode holds whatever the old one had
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(password); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+func (q *Qemu) readVNCPassword(vmid int) (string, error) {
+	data, err := os.ReadFile(q.vncPasswordPath(vmid))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+func (q *Qemu) getHostIP(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, "ip", "addr", "show", "vmbr0")
 	output, err := cmd.Output()
 	if err == nil {
 		/*
@@ -68,7 +131,7 @@ func (q *Qemu) getHostIP() (string, error) {
 		}
 	}
 
-	cmd = exec.Command("ip", "route", "get", "1.1.1.1")
+	cmd = exec.CommandContext(ctx, "ip", "route", "get", "1.1.1.1")
 	output, err = cmd.Output()
 	if err == nil {
 		/*
@@ -88,7 +151,7 @@ func (q *Qemu) getHostIP() (string, error) {
 		}
 	}
 
-	cmd = exec.Command("hostname", "-I")
+	cmd = exec.CommandContext(ctx, "hostname", "-I")
 	output, err = cmd.Output()
 	if err == nil {
 		ips := strings.Fields(string(output))
@@ -102,7 +165,7 @@ func (q *Qemu) getHostIP() (string, error) {
 	return "", fmt.Errorf("could not determine host IP")
 }
 
-func (q *Qemu) setVNCPassword(vmid int, password string) error {
+func (q *Qemu) setVNCPassword(ctx context.Context, vmid int, password string) error {
 	monitorPath := filepath.Join(q.Folder.Monitor, fmt.Sprintf("%d.sock", vmid))
 
 	maxRetries := 3
@@ -110,26 +173,33 @@ func (q *Qemu) setVNCPassword(vmid int, password string) error {
 		if _, err := os.Stat(monitorPath); err == nil {
 			break
 		}
-		time.Sleep(500 * time.Millisecond)
+		if err := sleepContext(ctx, 500*time.Millisecond); err != nil {
+			return err
+		}
 	}
 
-	conn, err := net.Dial("unix", monitorPath)
+	client, err := dialMonitor(ctx, monitorPath)
 	if err != nil {
 		return fmt.Errorf("failed to connect to monitor: %w", err)
 	}
-	// defer conn.Close()
+	defer client.Close()
+	conn := client.conn
 
 	buf := make([]byte, 4096)
+	client.setDeadline()
 	_, err = conn.Read(buf)
 	if err != nil {
-		return fmt.Errorf("failed to read from monitor: %w", err)
+		return fmt.Errorf("failed to read from monitor: %w", client.wrap(err))
 	}
 
-	time.Sleep(500 * time.Millisecond)
+	if err := sleepContext(ctx, 500*time.Millisecond); err != nil {
+		return err
+	}
 
+	client.setDeadline()
 	cmd := fmt.Sprintf("change vnc password %s\n", password)
 	if _, err := conn.Write([]byte(cmd)); err != nil {
-		return fmt.Errorf("failed to set password: %w", err)
+		return fmt.Errorf("failed to set password: %w", client.wrap(err))
 	}
 
 	response := ""
@@ -139,7 +209,7 @@ func (q *Qemu) setVNCPassword(vmid int, password string) error {
 			if err == io.EOF {
 				break
 			}
-			return fmt.Errorf("failed to read monitor response: %w", err)
+			return fmt.Errorf("failed to read monitor response: %w", client.wrap(err))
 		}
 		response += string(buf[:n])
 		if strings.Contains(response, "(qemu)") {
@@ -148,6 +218,8 @@ func (q *Qemu) setVNCPassword(vmid int, password string) error {
 	}
 
 	if !isSuccess(response) {
+		// * HMP echoes the command line, keep the password out of the error
+		response = strings.ReplaceAll(response, password, "***")
 		return fmt.Errorf("failed to set VNC password, monitor response: %s", response)
 	}
 